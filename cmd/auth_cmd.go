@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
+	"github.com/spf13/cobra"
+)
+
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Show and manage the credentials for the API",
+	Args:  cobra.MaximumNArgs(0),
+}
+
+var authStatusCmd = &cobra.Command{
+	Use:     "status",
+	Aliases: []string{"whoami"},
+	Short:   "Show who ik is logged in as and whether the API accepts the token",
+	Long: `Shows the host, username, connecter and token expiry of the active profile
+and checks the token with the API. Exits with a non-zero status when there is
+no token or the API rejects it.`,
+	Args: cobra.MaximumNArgs(0),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if authStatusOpts.Host == "" {
+			authStatusOpts.Host = configString("host")
+		}
+		if authStatusOpts.Host == "" {
+			return usageError(fmt.Errorf("`--host` is required"))
+		}
+		return completeTransportOptions(cmd.Flags(), &authStatusOpts.Transport)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return authStatus(cmd.Context(), authStatusOpts)
+	},
+}
+
+// whoamiCmd is `ik auth status` at the top-level
+var whoamiCmd = &cobra.Command{
+	Use:     "whoami",
+	Short:   authStatusCmd.Short,
+	Long:    authStatusCmd.Long,
+	Args:    authStatusCmd.Args,
+	PreRunE: authStatusCmd.PreRunE,
+	RunE:    authStatusCmd.RunE,
+}
+
+var authStatusOpts = &ConnectOptions{}
+
+func init() {
+	for _, c := range []*cobra.Command{authStatusCmd, whoamiCmd} {
+		c.Flags().StringVarP(&authStatusOpts.Host, "host", "H", "", "Infrakube API URL")
+		addTransportFlags(c.Flags(), &authStatusOpts.Transport)
+	}
+
+	authCmd.AddCommand(authStatusCmd)
+	rootCmd.AddCommand(authCmd)
+	rootCmd.AddCommand(whoamiCmd)
+}
+
+func authStatus(ctx context.Context, o *ConnectOptions) error {
+	token, source, err := lookupTokenSource(ctx, o.Host)
+	if err != nil {
+		return err
+	}
+
+	username := configString("username")
+	if subject := tokenSubject(token); subject != "" {
+		username = subject
+	}
+	var connecter string
+	if connecters, err := getConnecters(ctx, o); err != nil {
+		connecter = fmt.Sprintf("unknown (%s)", err)
+	} else {
+		connecter = strings.Join(connecters, ", ")
+	}
+
+	printStatus := func(key, value string) {
+		if value == "" {
+			value = "-"
+		}
+		fmt.Printf("%-11s %s\n", key+":", value)
+	}
+	if name := activeProfile(); name != "" {
+		printStatus("Profile", name)
+	}
+	printStatus("Host", o.Host)
+	printStatus("Username", username)
+	printStatus("Connecter", connecter)
+
+	if token == "" {
+		printStatus("Token", "none")
+		return authError(fmt.Errorf("not logged in to %s. Run `ik connect`", o.Host))
+	}
+	printStatus("Token", "from the "+source)
+	if source == tokenSourceEnv {
+		defer fmt.Fprintln(os.Stderr, "note: IK_TOKEN overrides the credential store")
+	}
+	if exp, ok := tokenExpiry(token); ok {
+		remaining := time.Until(exp)
+		if remaining <= 0 {
+			printStatus("Expires", fmt.Sprintf("%s (expired)", exp.Local().Format(time.RFC1123)))
+		} else {
+			printStatus("Expires", fmt.Sprintf("%s (in %s)", exp.Local().Format(time.RFC1123), remaining.Round(time.Second)))
+		}
+	} else {
+		printStatus("Expires", "unknown")
+	}
+
+	// The API accepts the token when it can be used to list the clients
+	_, err = listClients(ctx, o.Host, token, &o.Transport)
+	if errors.Is(err, stella.ErrNotSupported) {
+		// Without the endpoint there is no way to tell
+		printStatus("Status", "unknown, the API can't list clients")
+		return nil
+	}
+	if err != nil {
+		printStatus("Status", "rejected")
+		if ExitCode(err) == ExitAuth {
+			return authError(fmt.Errorf("the API rejected the token: %s. Run `ik connect`", err))
+		}
+		return err
+	}
+	printStatus("Status", "accepted")
+	return nil
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Completions are cached briefly so repeated tabs don't query the cluster or
+// the API each time
+const completionCacheTTL = 30 * time.Second
+
+// Completions are skipped when the cluster or the API doesn't respond within
+// completionTimeout, instead of blocking the shell
+const completionTimeout = 5 * time.Second
+
+type completionCache struct {
+	Time   time.Time `json:"time"`
+	Values []string  `json:"values"`
+}
+
+// loadCompletionConfig loads the config for completion functions. The
+// PersistentPreRunE of rootCmd skips completion commands because completion
+// must never prompt.
+func loadCompletionConfig() error {
+	nonInteractive = true
+	return loadConfig(nil)
+}
+
+// isCompletionCommand returns true for `ik completion` and the hidden commands
+// the completion scripts call.
+func isCompletionCommand(cmd *cobra.Command) bool {
+	switch cmd.Name() {
+	case cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		return true
+	}
+	return cmd.HasParent() && cmd.Parent().Name() == "completion"
+}
+
+// cachedCompletions returns the values cached under key, or calls fetch and
+// caches its result when the cache is missing or expired.
+func cachedCompletions(key []string, fetch func() ([]string, error)) []string {
+	sum := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+	name := filepath.Join(filepath.Dir(viper.ConfigFileUsed()), "cache", "completion", hex.EncodeToString(sum[:]))
+
+	var cache completionCache
+	if b, err := os.ReadFile(name); err == nil {
+		if json.Unmarshal(b, &cache) == nil && time.Since(cache.Time) < completionCacheTTL {
+			return cache.Values
+		}
+	}
+
+	values, err := fetch()
+	if err != nil {
+		cobra.CompDebugln(err.Error(), false)
+		return nil
+	}
+	sort.Strings(values)
+	if b, err := json.Marshal(completionCache{Time: time.Now(), Values: values}); err == nil {
+		writePrivateFile(name, b)
+	}
+	return values
+}
+
+func filterCompletions(values []string, toComplete string) []string {
+	var matches []string
+	for _, value := range values {
+		if strings.HasPrefix(value, toComplete) {
+			matches = append(matches, value)
+		}
+	}
+	return matches
+}
+
+// completeTfNames completes the name of a Tf resource in the namespace
+// selected by the flags, profile or kubeconfig.
+func completeTfNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	if err := loadCompletionConfig(); err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	tfNamespace := resolveNamespace(factory)
+	values := cachedCompletions([]string{"tfs", kubeConfigCacheKey(), tfNamespace}, func() ([]string, error) {
+		infrakubeclientset, err := factory.InfrakubeClientSet()
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), completionTimeout)
+		defer cancel()
+		tfList, err := infrakubeclientset.Infra3V1().Tfs(tfNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, tf := range tfList.Items {
+			names = append(names, tf.Name)
+		}
+		return names, nil
+	})
+	return filterCompletions(values, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeNamespaces completes the `--namespace` flag from the cluster.
+func completeNamespaces(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if err := loadCompletionConfig(); err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	values := cachedCompletions([]string{"namespaces", kubeConfigCacheKey()}, func() ([]string, error) {
+		clientset, err := factory.KubernetesClientSet()
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), completionTimeout)
+		defer cancel()
+		namespaceList, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, item := range namespaceList.Items {
+			names = append(names, item.Name)
+		}
+		return names, nil
+	})
+	return filterCompletions(values, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeClients completes the `--client` flag of `ik exec` from the API.
+func completeClients(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if err := loadCompletionConfig(); err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	apiHost := execOpts.Host
+	if apiHost == "" {
+		apiHost = configString("host")
+	}
+	if apiHost == "" {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	values := cachedCompletions([]string{"clients", credentialKey(apiHost)}, func() ([]string, error) {
+		token, err := lookupToken(cmd.Context(), apiHost)
+		if err != nil {
+			return nil, err
+		}
+		if err := completeTransportOptions(cmd.Flags(), &execOpts.Transport); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), completionTimeout)
+		defer cancel()
+		return listClients(ctx, apiHost, token, &execOpts.Transport)
+	})
+	return filterCompletions(values, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeProfiles completes the name of a profile in the config.
+func completeProfiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	if err := loadCompletionConfig(); err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return filterCompletions(names, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// kubeConfigCacheKey identifies the cluster selected by the kubeconfig flags.
+func kubeConfigCacheKey() string {
+	rawConfig, err := kubeConfigFlags.ToRawKubeConfigLoader().RawConfig()
+	if err != nil {
+		return ""
+	}
+	contextName := rawConfig.CurrentContext
+	if *kubeConfigFlags.Context != "" {
+		contextName = *kubeConfigFlags.Context
+	}
+	key := contextName
+	if kubeContext, ok := rawConfig.Contexts[contextName]; ok {
+		key += "/" + kubeContext.Cluster + "/" + kubeContext.AuthInfo
+	}
+	return key
+}
+
+// listClients returns the names of the clients (clusters) registered with the
+// API.
+func listClients(ctx context.Context, host, token string, transport *TransportOptions) ([]string, error) {
+	client, err := newStellaClient(host, transport)
+	if err != nil {
+		return nil, err
+	}
+	client.Token = token
+	names, err := client.Clients(ctx)
+	if errors.Is(err, stella.ErrNotSupported) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, stellaError(err)
+	}
+	return names, nil
+}
@@ -0,0 +1,369 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "View and modify the ik config",
+	Long: `View and modify the ik config (default is $HOME/.ik/config).
+
+Settings are resolved in the following order, the first one found wins:
+
+  1. Command line flags, eg '--host'
+  2. IK_* environment variables, eg 'IK_HOST' or 'IK_TOKEN'. The TFO_*
+     variables of terraform-operator are still read but deprecated
+  3. The active profile, selected by '--profile' or 'current-profile'
+  4. Top-level keys in the user's config
+  5. $HOME/.ik/global.yaml
+
+Tokens are kept in a credential store next to the config, keyed by host. Set
+'credential-store' to 'file' (default) or 'encrypted-file'. The passphrase of
+an encrypted store is read from IK_CREDENTIALS_PASSPHRASE or prompted for.
+
+The token is looked up in the following order:
+
+  1. IK_TOKEN
+  2. The command in 'credentialHelper' ('credential-helper' is an alias),
+     resolved like the settings above
+  3. The credential store
+  4. A 'token' saved in the config by older versions`,
+	Args: cobra.MaximumNArgs(0),
+}
+
+var configViewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "Print the config with secrets redacted",
+	Args:  cobra.MaximumNArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return configView()
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set <key> <value>",
+	Short: "Set a value in the config",
+	Long: `Set a value in the config. Profile keys (eg 'host' or 'client') are written to
+the active profile when there is one. Use a dotted key, eg 'profiles.prod.host',
+to set a value elsewhere.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if isTokenKey(resolveConfigKey(args[0])) {
+			return usageError(fmt.Errorf("tokens are kept in the credential store, run `ik connect` or set IK_TOKEN instead"))
+		}
+		return updateConfig(func(cfg map[string]interface{}) error {
+			setConfigKey(cfg, args[0], args[1])
+			return nil
+		})
+	},
+}
+
+var configUnsetCmd = &cobra.Command{
+	Use:   "unset <key>",
+	Short: "Remove a value from the config",
+	Long: `Remove a value from the config. Profile keys (eg 'host' or 'client') are removed
+from the active profile when there is one. Use a dotted key, eg 'profiles.prod.host',
+to remove a value elsewhere.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateConfig(func(cfg map[string]interface{}) error {
+			if !unsetConfigKey(cfg, args[0]) {
+				return notFoundError(fmt.Errorf("%s is not set", args[0]))
+			}
+			return nil
+		})
+	},
+}
+
+var configPathCmd = &cobra.Command{
+	Use:   "path",
+	Short: "Print the path of the config file in use",
+	Args:  cobra.MaximumNArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println(viper.ConfigFileUsed())
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config for unknown, deprecated or invalid keys",
+	Args:  cobra.MaximumNArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return configValidate()
+	},
+}
+
+// Keys that can be set at the top-level of the config or in a profile
+var profileConfigKeys = map[string]bool{
+	"host":      true,
+	"username":  true,
+	"token":     true,
+	"password":  true,
+	"client":    true,
+	"context":   true,
+	"namespace": true,
+
+	"certificate-authority":    true,
+	"client-certificate":       true,
+	"client-key":               true,
+	"insecure-skip-tls-verify": true,
+	"sso-port":                 true,
+	"credentialHelper":         true,
+	"credential-helper":        true,
+	"proxy-url":                true,
+	"headers":                  true,
+}
+
+// Keys that can only be set at the top-level of the config
+var topLevelConfigKeys = map[string]bool{
+	"current-profile":  true,
+	"profiles":         true,
+	"credential-store": true,
+}
+
+// Keys that are still read but should be removed from the config
+var deprecatedConfigKeys = map[string]string{
+	"password": "storing the password in plaintext is deprecated, use `ik connect --password-stdin` or IK_PASSWORD instead",
+	"config":   "written by older versions of ik and is ignored, run `ik migrate-config` to remove it",
+}
+
+// Keys that hold secrets and are redacted by `ik config view`. The values of
+// maps, eg headers, are redacted one by one.
+var secretConfigKeys = map[string]bool{
+	"token":    true,
+	"password": true,
+	"headers":  true,
+}
+
+var rawConfig bool
+
+func init() {
+	configViewCmd.Flags().BoolVar(&rawConfig, "raw", false, "Display secrets instead of redacting them")
+
+	configCmd.AddCommand(configViewCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configUnsetCmd)
+	configCmd.AddCommand(configPathCmd)
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+// resolveConfigKey maps a profile key, or a key inside one like
+// 'headers.X-Api-Key', to the active profile. Other keys are returned as is.
+func resolveConfigKey(key string) string {
+	first, _, _ := strings.Cut(key, ".")
+	if name := activeProfile(); name != "" && profileConfigKeys[first] {
+		return "profiles." + name + "." + key
+	}
+	return key
+}
+
+// isTokenKey reports whether a resolved key is the token at the top-level or
+// in a profile, which `ik config set` must not write in plaintext.
+func isTokenKey(key string) bool {
+	parts := strings.Split(key, ".")
+	switch len(parts) {
+	case 1:
+		return parts[0] == "token"
+	case 3:
+		return parts[0] == "profiles" && parts[2] == "token"
+	}
+	return false
+}
+
+func setConfigKey(cfg map[string]interface{}, key, value string) {
+	setConfigValue(cfg, resolveConfigKey(key), value)
+}
+
+func unsetConfigKey(cfg map[string]interface{}, key string) bool {
+	return unsetConfigValue(cfg, resolveConfigKey(key))
+}
+
+func readConfigFile() (map[string]interface{}, error) {
+	name := viper.ConfigFileUsed()
+	if name == "" {
+		return nil, fmt.Errorf("config file not defined")
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", name, err)
+	}
+	if cfg == nil {
+		cfg = map[string]interface{}{}
+	}
+	return cfg, nil
+}
+
+func redactConfig(cfg map[string]interface{}) {
+	for key, value := range cfg {
+		if m, ok := value.(map[string]interface{}); ok {
+			if secretConfigKeys[key] {
+				for name := range m {
+					m[name] = "REDACTED"
+				}
+			} else {
+				redactConfig(m)
+			}
+			continue
+		}
+		if secretConfigKeys[key] && value != "" {
+			cfg[key] = "REDACTED"
+		}
+	}
+}
+
+func configView() error {
+	cfg, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	if !rawConfig {
+		redactConfig(cfg)
+	}
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(b))
+	return nil
+}
+
+// configValidate prints any problems found in the config and returns a usage
+// error when the config has errors. Deprecated keys are only reported as
+// warnings.
+func configValidate() error {
+	cfg, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	errs, warnings := validateConfig(cfg)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	}
+	if len(errs) > 0 {
+		return usageError(fmt.Errorf("%s is not valid", viper.ConfigFileUsed()))
+	}
+	fmt.Printf("%s is valid\n", viper.ConfigFileUsed())
+	return nil
+}
+
+// validateConfig returns the errors, sorted, and the warnings found in cfg.
+func validateConfig(cfg map[string]interface{}) (errs, warnings []string) {
+	validateKeys := func(prefix string, m map[string]interface{}, allowTopLevel bool) {
+		var keys []string
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if reason, ok := deprecatedConfigKeys[key]; ok {
+				warnings = append(warnings, fmt.Sprintf("%s%s: %s", prefix, key, reason))
+				continue
+			}
+			if !profileConfigKeys[key] && !(allowTopLevel && topLevelConfigKeys[key]) {
+				errs = append(errs, fmt.Sprintf("%s%s: unknown key", prefix, key))
+				continue
+			}
+			switch key {
+			case "host":
+				if err := validateHost(fmt.Sprint(m[key])); err != nil {
+					errs = append(errs, fmt.Sprintf("%s%s: %s", prefix, key, err))
+				}
+			case "credential-store":
+				if !slices.Contains(credentialStores, fmt.Sprint(m[key])) {
+					errs = append(errs, fmt.Sprintf("%s%s: expected one of %s", prefix, key, strings.Join(credentialStores, ", ")))
+				}
+			case "insecure-skip-tls-verify":
+				if _, err := strconv.ParseBool(fmt.Sprint(m[key])); err != nil {
+					errs = append(errs, fmt.Sprintf("%s%s: expected true or false", prefix, key))
+				} else if m[key] == true || fmt.Sprint(m[key]) == "true" {
+					warnings = append(warnings, fmt.Sprintf("%s%s: the certificate of the API server is not verified", prefix, key))
+				}
+			case "sso-port":
+				if port, err := strconv.Atoi(fmt.Sprint(m[key])); err != nil || port < 0 || port > 65535 {
+					errs = append(errs, fmt.Sprintf("%s%s: expected a port number", prefix, key))
+				}
+			case "proxy-url":
+				o := &TransportOptions{ProxyURL: fmt.Sprint(m[key])}
+				if _, err := o.proxy(); err != nil {
+					errs = append(errs, fmt.Sprintf("%s%s: %s", prefix, key, strings.TrimPrefix(err.Error(), "proxy-url: ")))
+				}
+			case "headers":
+				headers, ok := m[key].(map[string]interface{})
+				if !ok {
+					errs = append(errs, fmt.Sprintf("%s%s: expected a map of header names to values", prefix, key))
+					break
+				}
+				for name := range headers {
+					if name == "" || strings.ContainsAny(name, " \t:") {
+						errs = append(errs, fmt.Sprintf("%s%s: invalid header name %q", prefix, key, name))
+					}
+				}
+			case "certificate-authority", "client-certificate", "client-key":
+				if _, err := os.Stat(fmt.Sprint(m[key])); err != nil {
+					errs = append(errs, fmt.Sprintf("%s%s: %s", prefix, key, err))
+				}
+			case "token":
+				warnings = append(warnings, fmt.Sprintf("%s%s: tokens are kept in the credential store now, run `ik migrate-config` to move it", prefix, key))
+			}
+		}
+	}
+
+	validateKeys("", cfg, true)
+
+	profiles := map[string]interface{}{}
+	if value, ok := cfg["profiles"]; ok {
+		profiles, ok = value.(map[string]interface{})
+		if !ok {
+			errs = append(errs, "profiles: expected a map of profile names")
+		}
+	}
+	for name, value := range profiles {
+		profile, ok := value.(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Sprintf("profiles.%s: expected a map of settings", name))
+			continue
+		}
+		validateKeys("profiles."+name+".", profile, false)
+	}
+	if current, ok := cfg["current-profile"].(string); ok && current != "" {
+		if _, ok := profiles[current]; !ok {
+			errs = append(errs, fmt.Sprintf("current-profile: profile %q not found", current))
+		}
+	}
+
+	sort.Strings(errs)
+	return errs, warnings
+}
+
+func validateHost(host string) error {
+	URL, err := url.Parse(host)
+	if err != nil {
+		return err
+	}
+	if URL.Scheme != "http" && URL.Scheme != "https" {
+		return fmt.Errorf("expected an http or https URL, got %q", host)
+	}
+	if URL.Host == "" {
+		return fmt.Errorf("missing the hostname in %q", host)
+	}
+	return nil
+}
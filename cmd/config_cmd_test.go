@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/viper"
+)
+
+func parseConfig(t *testing.T, config string) map[string]interface{} {
+	t.Helper()
+	cfg := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(config), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil {
+		cfg = map[string]interface{}{}
+	}
+	return cfg
+}
+
+func TestSetConfigValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		key    string
+		value  string
+		want   string
+	}{
+		{"top-level", "", "host", "https://a", "host: https://a"},
+		{"replace", "host: https://a", "host", "https://b", "host: https://b"},
+		{"new profile", "", "profiles.prod.host", "https://a", "profiles: {prod: {host: https://a}}"},
+		{"existing profile", "profiles: {prod: {client: c1}}", "profiles.prod.host", "https://a", "profiles: {prod: {client: c1, host: https://a}}"},
+		{"replace a value with a map", "profiles: prod", "profiles.prod.host", "https://a", "profiles: {prod: {host: https://a}}"},
+		{"header", "headers: {X-Team: infra}", "headers.X-Api-Key", "secret", "headers: {X-Team: infra, X-Api-Key: secret}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseConfig(t, tt.config)
+			setConfigValue(cfg, tt.key, tt.value)
+			if want := parseConfig(t, tt.want); !reflect.DeepEqual(cfg, want) {
+				t.Errorf("got %v, want %v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestUnsetConfigValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		key    string
+		want   string
+		wantOk bool
+	}{
+		{"top-level", "host: https://a\nclient: c1", "host", "client: c1", true},
+		{"profile", "profiles: {prod: {host: https://a, client: c1}}", "profiles.prod.host", "profiles: {prod: {client: c1}}", true},
+		{"missing key", "host: https://a", "client", "host: https://a", false},
+		{"missing profile", "profiles: {prod: {host: https://a}}", "profiles.dev.host", "profiles: {prod: {host: https://a}}", false},
+		{"not a map", "profiles: prod", "profiles.prod.host", "profiles: prod", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parseConfig(t, tt.config)
+			if ok := unsetConfigValue(cfg, tt.key); ok != tt.wantOk {
+				t.Errorf("got %t, want %t", ok, tt.wantOk)
+			}
+			if want := parseConfig(t, tt.want); !reflect.DeepEqual(cfg, want) {
+				t.Errorf("got %v, want %v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestIsTokenKey(t *testing.T) {
+	tests := map[string]bool{
+		"token":               true,
+		"profiles.prod.token": true,
+		"host":                false,
+		"headers.token":       false,
+		"profiles.token":      false,
+	}
+	for key, want := range tests {
+		if got := isTokenKey(key); got != want {
+			t.Errorf("isTokenKey(%q) = %t, want %t", key, got, want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		wantErrs     []string
+		wantWarnings []string
+	}{
+		{
+			name:   "valid",
+			config: "current-profile: prod\ncredential-store: encrypted-file\nprofiles: {prod: {host: https://a, sso-port: 8085, headers: {X-Api-Key: secret}}}",
+		},
+		{
+			name:     "unknown keys",
+			config:   "hots: https://a\nprofiles: {prod: {current-profile: dev}}",
+			wantErrs: []string{"hots: unknown key", "profiles.prod.current-profile: unknown key"},
+		},
+		{
+			name:   "invalid values",
+			config: "host: ftp://a\ncredential-store: keychain\nsso-port: 70000\ninsecure-skip-tls-verify: maybe\nheaders: {\"X Bad\": a}",
+			wantErrs: []string{
+				"credential-store: expected one of file, encrypted-file",
+				`headers: invalid header name "X Bad"`,
+				`host: expected an http or https URL, got "ftp://a"`,
+				"insecure-skip-tls-verify: expected true or false",
+				"sso-port: expected a port number",
+			},
+		},
+		{
+			name:     "missing current profile",
+			config:   "current-profile: dev\nprofiles: {prod: {host: https://a}}",
+			wantErrs: []string{`current-profile: profile "dev" not found`},
+		},
+		{
+			name:   "deprecated keys",
+			config: "config: /old\nprofiles: {prod: {host: https://a, password: hunter2, token: legacy}}",
+			wantWarnings: []string{
+				"config: " + deprecatedConfigKeys["config"],
+				"profiles.prod.password: " + deprecatedConfigKeys["password"],
+				"profiles.prod.token: tokens are kept in the credential store now, run `ik migrate-config` to move it",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, warnings := validateConfig(parseConfig(t, tt.config))
+			sort.Strings(warnings)
+			if !reflect.DeepEqual(errs, tt.wantErrs) {
+				t.Errorf("got errors %q, want %q", errs, tt.wantErrs)
+			}
+			if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+				t.Errorf("got warnings %q, want %q", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestConfigValidateExitCode(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(name, []byte("hots: https://a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(name)
+	t.Cleanup(viper.Reset)
+
+	if err := configValidate(); ExitCode(err) != ExitUsage {
+		t.Errorf("got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitUsage)
+	}
+}
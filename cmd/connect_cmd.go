@@ -1,20 +1,31 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/tls"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/galleybytes/infrakube-stella/pkg/api"
 	"github.com/gin-gonic/gin"
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
 	"github.com/skratchdot/open-golang/open"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	xterm "golang.org/x/term"
 )
@@ -22,163 +33,243 @@ import (
 var connectCmd = &cobra.Command{
 	Use:     "connect",
 	Aliases: []string{"co"},
-	Short:   "Authenticate with TFO API",
-	Long:    "Adds or updates the token in the TFOCONFIG",
+	Short:   "Authenticate with the Infrakube API",
+	Long:    "Saves a token for the API host in the credential store",
 	// Args: cobra.MaximumNArgs(1),
 	// Args: cobra.ExactArgs(1),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		viper.BindPFlag("host", cmd.Flags().Lookup("host"))
-		host = viper.GetString("host")
-		if host == "" {
-			return fmt.Errorf("`--host` is required")
+		if connectOpts.Host == "" {
+			connectOpts.Host = configString("host")
+		}
+		if connectOpts.Host == "" {
+			return usageError(fmt.Errorf("`--host` is required"))
 		}
 		if viper.ConfigFileUsed() == "" {
-			return fmt.Errorf("config file not defined")
+			return usageError(fmt.Errorf("config file not defined"))
 		}
-		return nil
+		return completeTransportOptions(cmd.Flags(), &connectOpts.Transport)
 	},
-	Run: func(cmd *cobra.Command, args []string) {
-		log.Println("Connecting to", host)
-		connect(host)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log.Println("Connecting to", connectOpts.Host)
+		return connect(cmd.Context(), connectOpts)
 	},
 }
 
+// ConnectOptions are the options of `ik connect`
+type ConnectOptions struct {
+	// Host is the URL of the API
+	Host     string
+	Username string
+	// PasswordStdin reads the password from stdin instead of prompting
+	PasswordStdin bool
+	Transport     TransportOptions
+	// SSOPort is the port of the SSO callback server, 0 picks a free one
+	SSOPort int
+	// Timeout is how long to wait for the SSO or device login
+	Timeout time.Duration
+	// Device logs in with a code entered on another device instead of
+	// opening a browser
+	Device bool
+	// NoStdin keeps the password from being read from a piped stdin when it
+	// is the input of another command, eg when exec logs in again
+	NoStdin bool
+}
+
+var connectOpts = &ConnectOptions{}
+
 func init() {
-	connectCmd.Flags().StringVarP(&host, "host", "H", "", "Terraform-Operator API URL")
-	connectCmd.Flags().StringVarP(&username, "username", "U", "", "Username of the API")
-	viper.BindPFlag("username", connectCmd.Flags().Lookup("username"))
+	connectCmd.Flags().StringVarP(&connectOpts.Host, "host", "H", "", "Infrakube API URL")
+	connectCmd.Flags().StringVarP(&connectOpts.Username, "username", "U", "", "Username of the API")
+	connectCmd.Flags().BoolVar(&connectOpts.PasswordStdin, "password-stdin", false, "Read the password from stdin")
+	addTransportFlags(connectCmd.Flags(), &connectOpts.Transport)
+	addSSOFlags(connectCmd.Flags(), connectOpts)
 	rootCmd.AddCommand(connectCmd)
 }
 
-func connect(host string) {
-	var token string
+func addSSOFlags(flags *pflag.FlagSet, o *ConnectOptions) {
+	flags.IntVar(&o.SSOPort, "sso-port", 0, "Port on 127.0.0.1 for the SSO callback (default is a free port)")
+	flags.DurationVar(&o.Timeout, "timeout", defaultSSOTimeout, "How long to wait for the SSO or device login")
+	flags.BoolVar(&o.Device, "device", false, "Log in by entering a code in a browser on any device, eg from a remote shell")
+}
 
-	connecter, err := getConnecter(host)
+// connect logs in to the API and saves the token in the credential store.
+func connect(ctx context.Context, o *ConnectOptions) error {
+	if source := externalTokenSource(); source != "" {
+		fmt.Fprintf(os.Stderr, "Using the token from %s, skipping connect\n", source)
+		return nil
+	}
+	var token *stella.Token
+
+	connecters, err := getConnecters(ctx, o)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	if connecter == "sso" {
-		token, err = ssoConnecter(host)
-		if err != nil {
-			log.Fatal(err)
+	connecter := defaultConnecter(connecters)
+	if o.Device {
+		if !slices.Contains(connecters, connecterDevice) {
+			return usageError(fmt.Errorf("%s does not support `--device`, it supports %s", o.Host, strings.Join(connecters, ", ")))
 		}
-	} else {
-		token, err = loginConnecter(host)
-		if err != nil {
-			log.Fatal(err)
+		connecter = connecterDevice
+	}
+	switch connecter {
+	case connecterDevice:
+		token, err = deviceConnecter(ctx, o)
+	case connecterSSO:
+		if !isInteractive() {
+			return usageError(fmt.Errorf("%s uses SSO which requires a browser. Use `--device` or set IK_TOKEN instead", o.Host))
 		}
+		token, err = ssoConnecter(ctx, o)
+	case connecterLogin:
+		token, err = loginConnecter(ctx, o)
+	default:
+		return usageError(fmt.Errorf("%s only supports logging in with %s, which ik does not support", o.Host, strings.Join(connecters, ", ")))
 	}
-	fmt.Println("Login succeeded")
-	viper.Set("host", host)
-	viper.Set("username", username)
-	viper.Set("token", token)
-	viper.WriteConfig()
-
+	if err != nil {
+		return err
+	}
+	if exp, ok := tokenExpiry(token.Token); ok {
+		fmt.Printf("Login succeeded, the token expires at %s\n", exp.Local().Format(time.RFC1123))
+	} else {
+		fmt.Println("Login succeeded")
+	}
+	if err := saveToken(ctx, o.Host, token); err != nil {
+		return err
+	}
+	return updateConfig(func(cfg map[string]interface{}) error {
+		setProfileValue(cfg, "host", o.Host)
+		if o.Username != "" {
+			setProfileValue(cfg, "username", o.Username)
+		}
+		// Tokens used to be saved in plaintext in the config
+		unsetConfigKey(cfg, "token")
+		return nil
+	})
 }
 
-func getConnecter(host string) (string, error) {
-	url := host + "/connect"
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	httpClient := http.Client{Transport: tr}
+// Connecters advertised by the API. The first one is the default, device
+// is only used with `--device` or when the API supports nothing else.
+const (
+	connecterLogin  = "login"
+	connecterSSO    = "sso"
+	connecterDevice = "device"
+)
 
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return "", err
+// defaultConnecter returns the first of connecters that ik supports, device
+// only when there is no other. It is empty when ik supports none of them.
+func defaultConnecter(connecters []string) string {
+	for _, connecter := range connecters {
+		if connecter == connecterLogin || connecter == connecterSSO {
+			return connecter
+		}
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	if slices.Contains(connecters, connecterDevice) {
+		return connecterDevice
 	}
+	return ""
+}
 
-	var respData api.Response
-	err = json.Unmarshal(body, &respData)
+// getConnecters returns the ways the API supports logging in.
+func getConnecters(ctx context.Context, o *ConnectOptions) ([]string, error) {
+	client, err := newStellaClient(o.Host, &o.Transport)
 	if err != nil {
-		return "", fmt.Errorf("error parsing %s: %s", url, string(body))
+		return nil, err
 	}
-
-	if respData.StatusInfo.StatusCode != 200 {
-		return "", fmt.Errorf(respData.StatusInfo.Message)
+	connecters, err := client.Connecters(ctx)
+	if err != nil {
+		return nil, stellaError(err)
 	}
-
-	return respData.Data.([]interface{})[0].(string), nil
+	return connecters, nil
 }
 
-func loginConnecter(host string) (string, error) {
-	url := host + "/login"
-	username = viper.GetString("username")
-	if username == "" {
+func loginConnecter(ctx context.Context, o *ConnectOptions) (*stella.Token, error) {
+	if o.Username == "" {
+		o.Username = configString("username")
+	}
+	if o.Username == "" {
+		if !isInteractive() || o.PasswordStdin {
+			return nil, usageError(fmt.Errorf("no username was found. Use `--username` or IK_USERNAME"))
+		}
 		fmt.Print("Login username: ")
-		fmt.Scanln(&username)
+		username, err := promptLine(ctx)
+		if err != nil {
+			return nil, err
+		}
+		o.Username = username
 	} else {
-		fmt.Printf("(Username %s)\n", username)
+		fmt.Printf("(Username %s)\n", o.Username)
 	}
 	var password []byte
-	password = []byte(viper.GetString("password")) // Not a very smart place to put a password...
-	if len(password) == 0 {
-		fmt.Print("Login password: ")
-
-		p, err := xterm.ReadPassword(int(os.Stdin.Fd()))
+	if o.PasswordStdin {
+		p, err := readStdinLine()
 		if err != nil {
-			return "", err
+			return nil, fmt.Errorf("failed to read the password from stdin: %s", err)
+		}
+		if len(p) == 0 {
+			return nil, usageError(fmt.Errorf("no password was read from stdin"))
 		}
-		fmt.Println()
 		password = p
 	}
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	httpClient := http.Client{Transport: tr}
-
-	d := struct {
-		Username string `json:"user"`
-		Password string `json:"password"`
-	}{
-		Username: username,
-		Password: string(password),
+	if len(password) == 0 {
+		if value, ok := lookupEnv("password"); ok {
+			password = []byte(value)
+		} else if value := configString("password"); value != "" {
+			fmt.Fprintln(os.Stderr, "warning: the password in the config is deprecated, use `--password-stdin` or IK_PASSWORD instead")
+			password = []byte(value)
+		}
 	}
-	b, err := json.Marshal(d)
-	if err != nil {
-		return "", err
+	if len(password) == 0 && !isInteractive() {
+		if xterm.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, usageError(fmt.Errorf("no password was found. Use `--password-stdin` or IK_PASSWORD"))
+		}
+		if o.NoStdin {
+			return nil, authError(fmt.Errorf("the token for %s expired. Run `ik connect` to log in again", o.Host))
+		}
+		p, err := readStdinLine()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the password from stdin: %s", err)
+		}
+		password = p
 	}
-	data := bytes.NewBuffer(b)
+	if len(password) == 0 {
+		fmt.Print("Login password: ")
 
-	resp, err := httpClient.Post(url, "application/json", data)
-	if err != nil {
-		return "", err
+		p, err := promptPassword(ctx)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println()
+		password = p
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	client, err := newStellaClient(o.Host, &o.Transport)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	var respData api.Response
-	err = json.Unmarshal(body, &respData)
-	if err != nil {
-		return "", err
+	t, err := client.Login(ctx, o.Username, string(password))
+	var statusErr *stella.StatusError
+	if errors.As(err, &statusErr) {
+		return nil, authError(statusErr)
 	}
+	return t, stellaError(err)
+}
 
-	if respData.StatusInfo.StatusCode != 200 {
-		return "", fmt.Errorf(respData.StatusInfo.Message)
-
+// readStdinLine reads a single line from stdin without the line ending.
+func readStdinLine() ([]byte, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
 	}
-
-	token := respData.Data.([]interface{})[0].(string)
-	return token, nil
+	return bytes.TrimRight(line, "\r\n"), nil
 }
 
-func corsMiddleware() gin.HandlerFunc {
+// corsMiddleware allows the SSO page of the API, and only it, to call the
+// local callback with fetch
+func corsMiddleware(origin string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Set CORS headers
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "*")
+		c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		c.Writer.Header().Set("Vary", "Origin")
 
 		// Check if the request method is OPTIONS
 		if c.Request.Method == "OPTIONS" {
@@ -192,50 +283,212 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
-func ssoConnecter(host string) (string, error) {
+// ssoConnecter logs in with the browser. The API redirects back to a server
+// on the loopback interface with a one-time code, which is exchanged for a
+// token with the PKCE verifier only this process knows. Callbacks without the
+// random state sent to the API are ignored. connect only uses it when ik is
+// run interactively.
+func ssoConnecter(ctx context.Context, o *ConnectOptions) (*stella.Token, error) {
+	client, err := newStellaClient(o.Host, &o.Transport)
+	if err != nil {
+		return nil, err
+	}
+	apiURL, err := url.Parse(o.Host)
+	if err != nil {
+		return nil, usageError(fmt.Errorf("invalid URL: %s", err))
+	}
+	port := o.SSOPort
+	if port == 0 {
+		if value := configString("sso-port"); value != "" {
+			port, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, usageError(fmt.Errorf("sso-port: expected a port number, got %q", value))
+			}
+		}
+	}
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = defaultSSOTimeout
+	}
+
+	state, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	// Only listen on loopback, port 0 picks a free port
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the SSO callback server: %s", err)
+	}
+	redirectURI := fmt.Sprintf("http://%s/connecter", listener.Addr())
 
 	gin.SetMode(gin.ReleaseMode)
 	gin.DefaultWriter = io.Discard // Shut up!
-	router := gin.Default()
-
-	router.Use(corsMiddleware())
-
-	stopCh := make(chan bool)
-	tokenCh := make(chan string)
-	errorCh := make(chan error)
-
-	router.Any("/connecter", func(c *gin.Context) {
-		token := c.Query("token")
-		defer func() {
-			stopCh <- true
-			tokenCh <- token
-		}()
-		if token == "" {
-			c.AbortWithError(http.StatusNotFound, fmt.Errorf("failed to get token"))
+	router := gin.New()
+	router.Use(gin.Recovery(), corsMiddleware(apiURL.Scheme+"://"+apiURL.Host))
+
+	resultCh := make(chan ssoResult, 1)
+	router.GET("/connecter", func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(state)) != 1 {
+			// Not a response to our request, keep waiting for the real one
+			c.String(http.StatusBadRequest, "invalid state\n")
 			return
 		}
-		fmt.Fprintln(c.Writer, " success!") // Response to send to caller
+		result := ssoResult{}
+		switch {
+		case c.Query("error") != "":
+			result.err = authError(fmt.Errorf("SSO failed: %s", c.Query("error")))
+		case c.Query("code") != "":
+			result.token, result.err = client.ExchangeSSOCode(c.Request.Context(), c.Query("code"), verifier, redirectURI)
+			var statusErr *stella.StatusError
+			if errors.As(result.err, &statusErr) {
+				result.err = authError(statusErr)
+			} else if result.err != nil {
+				result.err = tlsError(result.err)
+			}
+		case c.Query("token") != "":
+			// Servers without PKCE send the token itself
+			result.token = &stella.Token{Token: c.Query("token"), RefreshToken: c.Query("refresh_token")}
+		default:
+			result.err = authError(fmt.Errorf("the connecter did not receive a token"))
+		}
+		if result.err != nil {
+			c.String(http.StatusUnauthorized, "Login failed, return to the terminal for details\n")
+		} else {
+			c.String(http.StatusOK, "Login succeeded, you can close this window\n")
+		}
+		select {
+		case resultCh <- result:
+		default:
+		}
 	})
 
+	server := &http.Server{Handler: router, ReadHeaderTimeout: 10 * time.Second}
+	errorCh := make(chan error, 1)
 	go func() {
-		errorCh <- router.Run(":18080")
+		errorCh <- server.Serve(listener)
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		// Lets the response to the browser finish
+		server.Shutdown(shutdownCtx)
 	}()
 
 	// Once the server has started, connect to the SSO Identity Provider (IDP)
-	err := open.Start(host + "/sso")
-	if err != nil {
-		return "", err
+	ssoURL := client.SSOURL(redirectURI, state, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err := openBrowser(ssoURL); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open a browser: %s\n", err)
 	}
+	fmt.Fprintf(os.Stderr, "Log in with the browser, or open:\n\n  %s\n\nWaiting up to %s for the login to complete\n", ssoURL, timeout)
 
 	select {
 	case err := <-errorCh:
-		return "", err
-	case <-stopCh:
-		token := <-tokenCh
-		time.Sleep(100 * time.Millisecond) // Time for response to send
-		if token == "" {
-			return "", fmt.Errorf("the connecter did not receive a token")
+		return nil, err
+	case result := <-resultCh:
+		return result.token, result.err
+	case <-time.After(timeout):
+		return nil, timeoutError(fmt.Errorf("timed out after %s waiting for the SSO login", timeout))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Default of `ik connect --timeout`
+const defaultSSOTimeout = 5 * time.Minute
+
+// openBrowser opens the SSO login page, tests replace it with a fake browser
+var openBrowser = open.Start
+
+type ssoResult struct {
+	token *stella.Token
+	err   error
+}
+
+// The token of a device login is polled every deviceInterval, unless the API
+// sets the interval, which grows by deviceSlowDown each time the API asks to
+// slow down (RFC 8628). Tests poll faster.
+var (
+	deviceInterval = 5 * time.Second
+	deviceSlowDown = 5 * time.Second
+)
+
+// deviceConnecter logs in without a browser on this machine. The user opens
+// the verification URL on any device and enters the code while the API is
+// polled for the token.
+func deviceConnecter(ctx context.Context, o *ConnectOptions) (*stella.Token, error) {
+	client, err := newStellaClient(o.Host, &o.Transport)
+	if err != nil {
+		return nil, err
+	}
+	authorization, err := client.DeviceCode(ctx)
+	if errors.Is(err, stella.ErrNotSupported) {
+		return nil, usageError(fmt.Errorf("%s does not support `--device`", o.Host))
+	} else if err != nil {
+		return nil, stellaError(err)
+	}
+
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = defaultSSOTimeout
+	}
+	if expiresIn := time.Duration(authorization.ExpiresIn) * time.Second; expiresIn > 0 && expiresIn < timeout {
+		timeout = expiresIn
+	}
+	interval := time.Duration(authorization.Interval) * time.Second
+	if interval <= 0 {
+		interval = deviceInterval
+	}
+
+	fmt.Fprintf(os.Stderr, "Open %s and enter the code %s\n", authorization.VerificationURI, authorization.UserCode)
+	if authorization.VerificationURIComplete != "" {
+		fmt.Fprintf(os.Stderr, "or open %s\n", authorization.VerificationURIComplete)
+	}
+	fmt.Fprintf(os.Stderr, "Waiting up to %s for the login to complete\n", timeout.Round(time.Second))
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		t, err := client.DeviceToken(ctx, authorization.DeviceCode)
+		if err == nil {
+			return t, nil
+		}
+		// Errors of RFC 8628, the API keeps them as the status message
+		var statusErr *stella.StatusError
+		if !errors.As(err, &statusErr) {
+			return nil, tlsError(err)
 		}
-		return token, nil
+		switch statusErr.Message {
+		case stella.DeviceAuthorizationPending:
+		case stella.DeviceSlowDown:
+			interval += deviceSlowDown
+		case stella.DeviceAccessDenied:
+			return nil, authError(fmt.Errorf("the login was denied"))
+		case stella.DeviceExpiredToken:
+			return nil, timeoutError(fmt.Errorf("the code expired before the login completed"))
+		default:
+			return nil, stellaError(err)
+		}
+	}
+	return nil, timeoutError(fmt.Errorf("timed out after %s waiting for the device login", timeout.Round(time.Second)))
+}
+
+// randomString returns n random bytes encoded for use in URLs
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
@@ -0,0 +1,309 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/api"
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
+	"github.com/skratchdot/open-golang/open"
+)
+
+// TestLoginConnecterNoStdin checks that logging in again from exec leaves a
+// piped stdin to the remote command.
+func TestLoginConnecterNoStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := w.WriteString("input of the command\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	for _, prefix := range []string{envPrefix, legacyEnvPrefix} {
+		unsetenv(t, prefix+"PASSWORD")
+	}
+
+	o := &ConnectOptions{Host: "http://127.0.0.1:1", Username: "admin", NoStdin: true}
+	_, err = loginConnecter(context.Background(), o)
+	if ExitCode(err) != ExitAuth {
+		t.Fatalf("got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitAuth)
+	}
+	input, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(input) != "input of the command\n" {
+		t.Errorf("got stdin %q, want it unread", input)
+	}
+}
+
+func TestDefaultConnecter(t *testing.T) {
+	tests := []struct {
+		connecters []string
+		want       string
+	}{
+		{[]string{"sso"}, connecterSSO},
+		{[]string{"login", "sso"}, connecterLogin},
+		{[]string{"device", "sso"}, connecterSSO},
+		{[]string{"device", "login"}, connecterLogin},
+		{[]string{"saml", "login"}, connecterLogin},
+		{[]string{"device"}, connecterDevice},
+		{[]string{"saml"}, ""},
+	}
+	for _, tt := range tests {
+		if got := defaultConnecter(tt.connecters); got != tt.want {
+			t.Errorf("defaultConnecter(%q) = %q, want %q", tt.connecters, got, tt.want)
+		}
+	}
+}
+
+// writeAPIResponse writes an api.Response with statusCode as both the HTTP
+// status and the status_code of the response, as the API does.
+func writeAPIResponse(w http.ResponseWriter, statusCode int, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(api.Response{
+		StatusInfo: api.StatusInfo{StatusCode: statusCode, Message: message},
+		Data:       data,
+	})
+}
+
+// newDeviceServer returns an API whose device token endpoint answers each poll
+// with the next of responses, an RFC 8628 error or "" for the token. The time
+// of each poll is sent to polls.
+func newDeviceServer(t *testing.T, responses []string, polls chan<- time.Time) *httptest.Server {
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/device/code":
+			writeAPIResponse(w, http.StatusOK, "", []interface{}{stella.DeviceAuthorization{
+				DeviceCode:      "device-code",
+				UserCode:        "ABCD-EFGH",
+				VerificationURI: "https://sso.example.com/device",
+			}})
+		case "/device/token":
+			polls <- time.Now()
+			mu.Lock()
+			response := responses[0]
+			responses = responses[1:]
+			mu.Unlock()
+			if response != "" {
+				writeAPIResponse(w, http.StatusBadRequest, response, nil)
+				return
+			}
+			writeAPIResponse(w, http.StatusOK, "", []interface{}{"device-token"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDeviceConnecter(t *testing.T) {
+	interval, slowDown := deviceInterval, deviceSlowDown
+	deviceInterval, deviceSlowDown = 10*time.Millisecond, 200*time.Millisecond
+	defer func() { deviceInterval, deviceSlowDown = interval, slowDown }()
+
+	tests := []struct {
+		name      string
+		responses []string
+		wantToken string
+		wantCode  int
+		// wantGaps is the minimum time between polls
+		wantGaps []time.Duration
+	}{
+		{
+			name:      "pending",
+			responses: []string{stella.DeviceAuthorizationPending, stella.DeviceAuthorizationPending, ""},
+			wantToken: "device-token",
+			wantGaps:  []time.Duration{deviceInterval, deviceInterval},
+		},
+		{
+			name:      "slow down",
+			responses: []string{stella.DeviceSlowDown, stella.DeviceAuthorizationPending, ""},
+			wantToken: "device-token",
+			wantGaps:  []time.Duration{deviceInterval + deviceSlowDown, deviceInterval + deviceSlowDown},
+		},
+		{
+			name:      "expired",
+			responses: []string{stella.DeviceAuthorizationPending, stella.DeviceExpiredToken},
+			wantCode:  ExitTimeout,
+			wantGaps:  []time.Duration{deviceInterval},
+		},
+		{
+			name:      "denied",
+			responses: []string{stella.DeviceAccessDenied},
+			wantCode:  ExitAuth,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polls := make(chan time.Time, len(tt.responses))
+			server := newDeviceServer(t, tt.responses, polls)
+			o := &ConnectOptions{Host: server.URL, Timeout: 10 * time.Second}
+
+			token, err := deviceConnecter(context.Background(), o)
+			if tt.wantCode != 0 {
+				if ExitCode(err) != tt.wantCode {
+					t.Fatalf("got %v (exit code %d), want exit code %d", err, ExitCode(err), tt.wantCode)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if token.Token != tt.wantToken {
+				t.Errorf("got token %q, want %q", token.Token, tt.wantToken)
+			}
+
+			close(polls)
+			var times []time.Time
+			for poll := range polls {
+				times = append(times, poll)
+			}
+			if len(times) != len(tt.responses) {
+				t.Fatalf("got %d polls, want %d", len(times), len(tt.responses))
+			}
+			for i, want := range tt.wantGaps {
+				if gap := times[i+1].Sub(times[i]); gap < want {
+					t.Errorf("poll %d came %s after the previous one, want at least %s", i+2, gap, want)
+				}
+			}
+		})
+	}
+}
+
+// newSSOServer returns an API whose SSO token endpoint exchanges "sso-code"
+// for a token when the PKCE verifier matches the challenge of the login page,
+// which the fake browser sends to challenges.
+func newSSOServer(t *testing.T, challenges <-chan string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sso/token" {
+			http.NotFound(w, r)
+			return
+		}
+		var request struct {
+			Code         string `json:"code"`
+			CodeVerifier string `json:"code_verifier"`
+			RedirectURI  string `json:"redirect_uri"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeAPIResponse(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		verifier := sha256.Sum256([]byte(request.CodeVerifier))
+		if request.Code != "sso-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != <-challenges {
+			writeAPIResponse(w, http.StatusUnauthorized, "invalid_grant", nil)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, "", []interface{}{"sso-token"})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakeBrowser replaces openBrowser with a browser that calls back the
+// redirect_uri of the login page with the query returned by callback, which
+// gets the query of the login page. The status of each callback is sent to
+// statuses.
+func fakeBrowser(t *testing.T, callback func(page url.Values) []url.Values, statuses chan<- int) {
+	t.Cleanup(func() { openBrowser = open.Start })
+	openBrowser = func(loginURL string) error {
+		URL, err := url.Parse(loginURL)
+		if err != nil {
+			return err
+		}
+		page := URL.Query()
+		go func() {
+			for _, query := range callback(page) {
+				resp, err := http.Get(page.Get("redirect_uri") + "?" + query.Encode())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}
+		}()
+		return nil
+	}
+}
+
+func TestSSOConnecter(t *testing.T) {
+	challenges := make(chan string, 1)
+	server := newSSOServer(t, challenges)
+	statuses := make(chan int, 2)
+	fakeBrowser(t, func(page url.Values) []url.Values {
+		if page.Get("code_challenge_method") != "S256" {
+			t.Errorf("got code_challenge_method %q, want S256", page.Get("code_challenge_method"))
+		}
+		challenges <- page.Get("code_challenge")
+		return []url.Values{
+			{"state": {"forged"}, "code": {"sso-code"}},
+			{"state": {page.Get("state")}, "code": {"sso-code"}},
+		}
+	}, statuses)
+
+	o := &ConnectOptions{Host: server.URL, Timeout: 10 * time.Second}
+	token, err := ssoConnecter(context.Background(), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "sso-token" {
+		t.Errorf("got token %q, want sso-token", token.Token)
+	}
+	if status := <-statuses; status != http.StatusBadRequest {
+		t.Errorf("got status %d for a forged state, want %d", status, http.StatusBadRequest)
+	}
+	if status := <-statuses; status != http.StatusOK {
+		t.Errorf("got status %d for the login, want %d", status, http.StatusOK)
+	}
+}
+
+func TestSSOConnecterStateMismatch(t *testing.T) {
+	server := newSSOServer(t, nil)
+	statuses := make(chan int, 1)
+	fakeBrowser(t, func(page url.Values) []url.Values {
+		return []url.Values{{"state": {page.Get("state") + "x"}, "token": {"forged-token"}}}
+	}, statuses)
+
+	o := &ConnectOptions{Host: server.URL, Timeout: 500 * time.Millisecond}
+	token, err := ssoConnecter(context.Background(), o)
+	if ExitCode(err) != ExitTimeout {
+		t.Fatalf("got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitTimeout)
+	}
+	if token != nil {
+		t.Errorf("got token %q from a callback with the wrong state", token.Token)
+	}
+	if status := <-statuses; status != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestSSOConnecterTimeout(t *testing.T) {
+	server := newSSOServer(t, nil)
+	fakeBrowser(t, func(page url.Values) []url.Values { return nil }, nil)
+
+	o := &ConnectOptions{Host: server.URL, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	_, err := ssoConnecter(context.Background(), o)
+	if ExitCode(err) != ExitTimeout {
+		t.Fatalf("got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %s, want after the 100ms timeout", elapsed)
+	}
+}
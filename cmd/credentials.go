@@ -0,0 +1,418 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/viper"
+)
+
+// CredentialStore saves API tokens keyed by the host URL they belong to.
+type CredentialStore interface {
+	// Get returns the token for host or an empty string when there is none
+	Get(host string) (string, error)
+	Set(host, token string) error
+	Delete(host string) error
+}
+
+// Values for the credential-store config key
+const (
+	credentialStoreFile          = "file"
+	credentialStoreEncryptedFile = "encrypted-file"
+)
+
+var credentialStores = []string{credentialStoreFile, credentialStoreEncryptedFile}
+
+// newCredentialStore returns the store selected by the credential-store key
+// of the config. Credentials are kept next to the config file. The passphrase
+// of an encrypted store is prompted for until ctx is done.
+func newCredentialStore(ctx context.Context) (CredentialStore, error) {
+	dir := filepath.Dir(viper.ConfigFileUsed())
+	switch kind := viper.GetString("credential-store"); kind {
+	case "", credentialStoreFile:
+		return &fileCredentialStore{path: filepath.Join(dir, "credentials")}, nil
+	case credentialStoreEncryptedFile:
+		return &fileCredentialStore{path: filepath.Join(dir, "credentials.enc"), passphrase: func() ([]byte, error) {
+			return credentialsPassphrase(ctx)
+		}}, nil
+	default:
+		return nil, usageError(fmt.Errorf("unknown credential-store %q, expected one of %s", kind, strings.Join(credentialStores, ", ")))
+	}
+}
+
+// credentialsPassphrase returns the passphrase of the encrypted credentials
+// file from IK_CREDENTIALS_PASSPHRASE or by prompting for it.
+func credentialsPassphrase(ctx context.Context) ([]byte, error) {
+	if value := getEnv("credentials-passphrase"); value != "" {
+		return []byte(value), nil
+	}
+	if !isInteractive() {
+		return nil, usageError(fmt.Errorf("the credentials file is encrypted. Set IK_CREDENTIALS_PASSPHRASE"))
+	}
+	fmt.Fprint(os.Stderr, "Credentials passphrase: ")
+	p, err := promptPassword(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr)
+	if len(p) == 0 {
+		return nil, usageError(fmt.Errorf("the passphrase can not be empty"))
+	}
+	return p, nil
+}
+
+// Where a token was found by lookupTokenSource
+const (
+	tokenSourceEnv    = "IK_TOKEN"
+	tokenSourceHelper = "credentialHelper"
+	tokenSourceStore  = "credential store"
+	tokenSourceConfig = "config"
+)
+
+// Keys of the credential helper command, credential-helper is an alias of
+// credentialHelper
+var credentialHelperKeys = []string{"credentialHelper", "credential-helper"}
+
+// How long a credential helper may take to print the token
+const credentialHelperTimeout = 30 * time.Second
+
+// lookupToken returns the token for host from IK_TOKEN, the credentialHelper
+// of the profile, the credential store or, for configs written by older
+// versions of ik, the config itself.
+func lookupToken(ctx context.Context, host string) (string, error) {
+	token, _, err := lookupTokenSource(ctx, host)
+	return token, err
+}
+
+// lookupTokenSource is lookupToken that also returns where the token was
+// found.
+func lookupTokenSource(ctx context.Context, host string) (string, string, error) {
+	if value := getEnv("token"); value != "" {
+		return value, tokenSourceEnv, nil
+	}
+	if helper := credentialHelper(); helper != "" {
+		value, err := credentialHelperToken(ctx, helper, host)
+		return value, tokenSourceHelper, err
+	}
+	store, err := newCredentialStore(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	value, err := store.Get(host)
+	if err != nil {
+		return "", "", err
+	}
+	if value != "" {
+		return value, tokenSourceStore, nil
+	}
+	if value := configString("token"); value != "" {
+		return value, tokenSourceConfig, nil
+	}
+	return "", "", nil
+}
+
+// externalTokenSource returns where the token comes from when it is not
+// managed by ik, ie IK_TOKEN or a credential helper. Such tokens are never
+// renewed or saved by ik.
+func externalTokenSource() string {
+	if getEnv("token") != "" {
+		return tokenSourceEnv
+	}
+	if credentialHelper() != "" {
+		return tokenSourceHelper
+	}
+	return ""
+}
+
+// credentialHelper returns the command set in the credentialHelper key, or in
+// its alias credential-helper, with the precedence of configString. The
+// environment variable is IK_CREDENTIAL_HELPER.
+func credentialHelper() string {
+	if value, ok := lookupEnv("credential-helper"); ok {
+		return value
+	}
+	if name := activeProfile(); name != "" {
+		for _, key := range credentialHelperKeys {
+			if value := viper.GetString("profiles." + name + "." + key); value != "" {
+				return value
+			}
+		}
+	}
+	for _, key := range credentialHelperKeys {
+		if value := viper.GetString(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// credentialHelperToken runs helper with "get" and the host on stdin, like a
+// docker credential helper. The helper prints the token as JSON, either
+// {"token": "..."} or docker's {"Secret": "..."}. The helper is killed when
+// ctx is done or after credentialHelperTimeout.
+func credentialHelperToken(ctx context.Context, helper, host string) (string, error) {
+	args := strings.Fields(helper)
+	if len(args) == 0 {
+		return "", usageError(fmt.Errorf("credentialHelper is empty"))
+	}
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, args[0], append(args[1:], "get")...)
+	c.Stdin = strings.NewReader(credentialKey(host) + "\n")
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return "", ctx.Err()
+		}
+		if ctx.Err() != nil {
+			return "", timeoutError(fmt.Errorf("credentialHelper %q did not finish in %s", args[0], credentialHelperTimeout))
+		}
+		return "", authError(fmt.Errorf("credentialHelper %q failed: %s %s", args[0], err, strings.TrimSpace(stderr.String())))
+	}
+
+	var output struct {
+		Token  string `json:"token"`
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return "", fmt.Errorf("credentialHelper %q printed invalid JSON: %s", args[0], err)
+	}
+	if output.Token == "" {
+		output.Token = output.Secret
+	}
+	if output.Token == "" {
+		return "", authError(fmt.Errorf("credentialHelper %q did not print a token for %s", args[0], host))
+	}
+	return output.Token, nil
+}
+
+// credentialKey normalizes host so "https://Example.com/" and
+// "https://example.com" share a token.
+func credentialKey(host string) string {
+	URL, err := url.Parse(strings.TrimSpace(host))
+	if err != nil || URL.Host == "" {
+		return strings.TrimRight(host, "/")
+	}
+	key := strings.ToLower(URL.Scheme) + "://" + strings.ToLower(URL.Host) + strings.TrimRight(URL.Path, "/")
+	if URL.Fragment != "" {
+		key += "#" + URL.Fragment
+	}
+	return key
+}
+
+// fileCredentialStore keeps tokens in a file only readable by the user. When
+// passphrase is set the file is encrypted with AES-GCM using a key derived
+// from the passphrase.
+type fileCredentialStore struct {
+	path       string
+	passphrase func() ([]byte, error)
+
+	// key is derived once per run so the passphrase is only asked for once
+	key  []byte
+	salt []byte
+}
+
+// encryptedCredentials is the format of an encrypted credentials file
+type encryptedCredentials struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+const (
+	credentialsKeyIterations = 600000
+	credentialsKeyLength     = 32
+)
+
+func (s *fileCredentialStore) Get(host string) (string, error) {
+	tokens, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	return tokens[credentialKey(host)], nil
+}
+
+func (s *fileCredentialStore) Set(host, token string) error {
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+	tokens[credentialKey(host)] = token
+	return s.write(tokens)
+}
+
+func (s *fileCredentialStore) Delete(host string) error {
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[credentialKey(host)]; !ok {
+		return nil
+	}
+	delete(tokens, credentialKey(host))
+	return s.write(tokens)
+}
+
+func (s *fileCredentialStore) read() (map[string]string, error) {
+	tokens := map[string]string{}
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.passphrase != nil {
+		b, err = s.decrypt(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := yaml.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", s.path, err)
+	}
+	if tokens == nil {
+		tokens = map[string]string{}
+	}
+	return tokens, nil
+}
+
+func (s *fileCredentialStore) write(tokens map[string]string) error {
+	b, err := yaml.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	if s.passphrase != nil {
+		b, err = s.encrypt(b)
+		if err != nil {
+			return err
+		}
+	}
+	return writePrivateFile(s.path, b)
+}
+
+func (s *fileCredentialStore) deriveKey(salt []byte) error {
+	if s.key != nil && string(s.salt) == string(salt) {
+		return nil
+	}
+	passphrase, err := s.passphrase()
+	if err != nil {
+		return err
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, credentialsKeyIterations, credentialsKeyLength)
+	if err != nil {
+		return err
+	}
+	s.key, s.salt = key, salt
+	return nil
+}
+
+func (s *fileCredentialStore) decrypt(b []byte) ([]byte, error) {
+	var file encryptedCredentials
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", s.path, err)
+	}
+	if file.Version != 1 {
+		return nil, fmt.Errorf("unsupported version %d of %s", file.Version, s.path)
+	}
+	if err := s.deriveKey(file.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, authError(fmt.Errorf("failed to decrypt %s, is the passphrase correct?", s.path))
+	}
+	return data, nil
+}
+
+func (s *fileCredentialStore) encrypt(data []byte) ([]byte, error) {
+	salt := s.salt
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.deriveKey(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(s.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(encryptedCredentials{
+		Version: 1,
+		Salt:    salt,
+		Nonce:   nonce,
+		Data:    gcm.Seal(nil, nonce, data, nil),
+	})
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writePrivateFile replaces name with data, making sure only the user can read
+// it. The data is written to a temporary file first so a failed write never
+// leaves a truncated file behind. A symlink, eg to a config kept in a dotfiles
+// repo, is followed so the file it points to is replaced instead of the link.
+func writePrivateFile(name string, data []byte) error {
+	if path, err := filepath.EvalSymlinks(name); err == nil {
+		name = path
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
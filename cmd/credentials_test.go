@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEncryptedStore(path, passphrase string) *fileCredentialStore {
+	return &fileCredentialStore{path: path, passphrase: func() ([]byte, error) {
+		return []byte(passphrase), nil
+	}}
+}
+
+func TestEncryptedCredentialStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.enc")
+	if err := newEncryptedStore(path, "correct horse").Set("https://Example.com/", "secret-token"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret-token") {
+		t.Errorf("the token is saved in plaintext: %s", b)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("got mode %o, want 600", mode)
+	}
+
+	token, err := newEncryptedStore(path, "correct horse").Get("https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "secret-token" {
+		t.Errorf("got token %q, want %q", token, "secret-token")
+	}
+
+	_, err = newEncryptedStore(path, "wrong horse").Get("https://example.com")
+	if ExitCode(err) != ExitAuth {
+		t.Errorf("wrong passphrase: got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitAuth)
+	}
+
+	var file encryptedCredentials
+	if err := json.Unmarshal(b, &file); err != nil {
+		t.Fatal(err)
+	}
+	file.Data[0] ^= 1
+	tampered, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newEncryptedStore(path, "correct horse").Get("https://example.com")
+	if ExitCode(err) != ExitAuth {
+		t.Errorf("tampered file: got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitAuth)
+	}
+}
+
+func TestFileCredentialStoreMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ik", "credentials")
+	store := &fileCredentialStore{path: path}
+	if err := store.Set("https://example.com", "secret-token"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("got mode %o, want 600", mode)
+	}
+	if err := store.Delete("https://example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.Get("https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		t.Errorf("got token %q after delete, want none", token)
+	}
+}
+
+func TestWritePrivateFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "config")
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, []byte("host: a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "config")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePrivateFile(link, []byte("host: b\n")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("%s was replaced with a regular file", link)
+	}
+	b, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "host: b\n" {
+		t.Errorf("got %q in the target, want %q", b, "host: b\n")
+	}
+}
+
+func TestCredentialHelperTokenCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err := credentialHelperToken(ctx, "sleep 5", "https://example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the helper ran for %s after the context was cancelled", elapsed)
+	}
+}
@@ -1,49 +1,217 @@
 package cmd
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
 	"github.com/skratchdot/open-golang/open"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var dashboardCmd = &cobra.Command{
-	Use:     "dashboard",
+	Use:     "dashboard [tf-resource-name]",
 	Aliases: []string{"co"},
-	Short:   "Login to the dashboard with token",
-	Long:    "Using 'ik dashboard' automatically authenticates the cli by first calling 'connect'",
+	Short:   "Open the dashboard in the browser",
+	Long: `Using 'ik dashboard' automatically authenticates the cli by first calling 'connect'.
+
+The dashboard is served through a proxy on 127.0.0.1 that adds the token to
+every request, so the token never appears in a URL. The proxy runs until ik is
+stopped with Ctrl-C. Pass the name of a Tf resource to open its page.`,
+	Args: cobra.MaximumNArgs(1),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		viper.BindPFlag("host", cmd.Flags().Lookup("host"))
-		host = viper.GetString("host")
-		if host == "" {
-			return fmt.Errorf("`--host` is required")
+		o := dashboardOpts
+		if o.Host == "" {
+			o.Host = configString("host")
+		}
+		if o.Host == "" {
+			return usageError(fmt.Errorf("`--host` is required"))
 		}
 		if viper.ConfigFileUsed() == "" {
-			return fmt.Errorf("config file not defined")
+			return usageError(fmt.Errorf("config file not defined"))
+		}
+		if len(args) > 0 {
+			o.Name = args[0]
+			if o.ClientName == "" {
+				o.ClientName = configString("client")
+			}
+			if o.ClientName == "" {
+				return usageError(fmt.Errorf("`--client` is required to open a Tf resource"))
+			}
+			o.Namespace = resolveNamespace(factory)
 		}
-		return nil
+		return completeTransportOptions(cmd.Flags(), &o.Transport)
 	},
-	Run: func(cmd *cobra.Command, args []string) {
-		log.Println("Connecting to", host)
-		connect(host)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log.Println("Connecting to", dashboardOpts.Host)
+		if err := connect(cmd.Context(), &dashboardOpts.ConnectOptions); err != nil {
+			return err
+		}
 		log.Println("Loading dashboard")
-		token = viper.GetString("token")
-		dashboard(token)
+		token, err := lookupToken(cmd.Context(), dashboardOpts.Host)
+		if err != nil {
+			return err
+		}
+		return dashboard(cmd.Context(), dashboardOpts, token)
 	},
 }
 
+// DashboardOptions are the options of `ik dashboard`
+type DashboardOptions struct {
+	ConnectOptions
+	ClientName string
+	Namespace  string
+	// Name of the Tf resource to open, the dashboard's home page is opened
+	// when it is empty
+	Name string
+	// NoBrowser prints the link to the dashboard instead of opening it
+	NoBrowser bool
+}
+
+var dashboardOpts = &DashboardOptions{}
+
 func init() {
-	dashboardCmd.Flags().StringVarP(&host, "host", "H", "", "Terraform-Operator API URL")
-	dashboardCmd.Flags().StringVarP(&username, "username", "U", "", "Username of the API")
-	viper.BindPFlag("username", dashboardCmd.Flags().Lookup("username"))
+	dashboardCmd.Flags().StringVarP(&dashboardOpts.Host, "host", "H", "", "Infrakube API URL")
+	dashboardCmd.Flags().StringVarP(&dashboardOpts.Username, "username", "U", "", "Username of the API")
+	dashboardCmd.Flags().BoolVar(&dashboardOpts.PasswordStdin, "password-stdin", false, "Read the password from stdin")
+	dashboardCmd.Flags().StringVarP(&dashboardOpts.ClientName, "client", "c", "", "The client identifier of the Tf resource")
+	dashboardCmd.Flags().BoolVar(&dashboardOpts.NoBrowser, "no-browser", false, "Print the link to the dashboard instead of opening a browser")
+	addTransportFlags(dashboardCmd.Flags(), &dashboardOpts.Transport)
+	addSSOFlags(dashboardCmd.Flags(), &dashboardOpts.ConnectOptions)
+	dashboardCmd.RegisterFlagCompletionFunc("client", completeClients)
 	rootCmd.AddCommand(dashboardCmd)
 }
 
-func dashboard(token string) {
-	err := open.Start(host + "/dashboard?token=" + token)
+// Path on the local proxy that exchanges the secret in the link printed by
+// `ik dashboard` for a session cookie
+const dashboardLoginPath = "/.ik/login"
+
+// dashboard serves the dashboard of o.Host on 127.0.0.1 until ctx is done,
+// then returns an interrupted error. The proxy adds token to every request.
+// Only a browser that opened the link with the random secret of this session
+// gets the cookie required to use it, so other local users and websites can't
+// use the token.
+func dashboard(ctx context.Context, o *DashboardOptions, token string) error {
+	target, err := url.Parse(o.Host)
 	if err != nil {
-		log.Fatal(err)
+		return usageError(fmt.Errorf("invalid URL: %s", err))
+	}
+	transport, err := newTransport(&o.Transport)
+	if err != nil {
+		return err
+	}
+	header, err := o.Transport.header()
+	if err != nil {
+		return err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start the dashboard proxy: %s", err)
+	}
+	localURL := "http://" + listener.Addr().String()
+	// Cookies are not separated by port, the name keeps sessions apart
+	cookieName := "ik-dashboard-" + strings.ReplaceAll(listener.Addr().String(), ":", "-")
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			removeCookie(r.Out, cookieName)
+			for name, values := range header {
+				r.Out.Header[name] = values
+			}
+			r.Out.Header.Set("Token", token)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// Keep redirects within the dashboard on the proxy
+			if location := resp.Header.Get("Location"); strings.HasPrefix(location, o.Host) {
+				resp.Header.Set("Location", localURL+strings.TrimPrefix(location, o.Host))
+			}
+			return nil
+		},
+		Transport: transport,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dashboardLoginPath, func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("secret")), []byte(secret)) != 1 {
+			http.Error(w, "invalid secret, open the link printed by `ik dashboard`", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    secret,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		next := r.URL.Query().Get("next")
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+			next = "/dashboard"
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(cookieName)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(secret)) != 1 {
+			http.Error(w, "not logged in, open the link printed by `ik dashboard`", http.StatusForbidden)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	errorCh := make(chan error, 1)
+	go func() {
+		errorCh <- server.Serve(listener)
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	link := localURL + dashboardLoginPath + "?" + url.Values{
+		"secret": {secret},
+		"next":   {stella.DashboardPath(o.ClientName, o.Namespace, o.Name)},
+	}.Encode()
+	if o.NoBrowser {
+		fmt.Println(link)
+	} else if err := open.Start(link); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open a browser: %s\n", err)
+		fmt.Println(link)
+	}
+	fmt.Fprintln(os.Stderr, "Serving the dashboard, press Ctrl-C to stop")
+
+	select {
+	case err := <-errorCh:
+		return err
+	case <-ctx.Done():
+		return interruptedError()
+	}
+}
+
+// removeCookie removes the cookie name from the Cookie header of req.
+func removeCookie(req *http.Request, name string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			req.AddCookie(cookie)
+		}
 	}
 }
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Environment variables are prefixed with IK_. The TFO_ prefix used by
+// terraform-operator is still read, with a warning, until configs and scripts
+// are migrated.
+const (
+	envPrefix       = "IK_"
+	legacyEnvPrefix = "TFO_"
+)
+
+// warnedEnv keeps the deprecation warning to one per variable. Concurrent
+// sessions look up variables too, so it is guarded by warnedEnvMu.
+var (
+	warnedEnvMu sync.Mutex
+	warnedEnv   = map[string]bool{}
+)
+
+// lookupEnv returns the value of IK_<name>, or of the deprecated TFO_<name>
+// when only that one is set. name is a config key, eg "host" or
+// "credentials-passphrase".
+func lookupEnv(name string) (string, bool) {
+	name = envName(name)
+	if value, ok := os.LookupEnv(envPrefix + name); ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(legacyEnvPrefix + name); ok {
+		warnedEnvMu.Lock()
+		if !warnedEnv[name] {
+			warnedEnv[name] = true
+			fmt.Fprintf(os.Stderr, "warning: %s%s is deprecated, use %s%s instead\n", legacyEnvPrefix, name, envPrefix, name)
+		}
+		warnedEnvMu.Unlock()
+		return value, true
+	}
+	return "", false
+}
+
+// getEnv is lookupEnv without the ok
+func getEnv(name string) string {
+	value, _ := lookupEnv(name)
+	return value
+}
+
+// envName converts a config key to the suffix of its environment variable, ie
+// "current-profile" to "CURRENT_PROFILE".
+func envName(key string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
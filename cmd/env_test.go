@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+// unsetenv unsets name for the duration of the test
+func unsetenv(t *testing.T, name string) {
+	t.Helper()
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+func TestLookupEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		key    string
+		want   string
+		wantOk bool
+	}{
+		{"current", map[string]string{"IK_HOST": "https://ik"}, "host", "https://ik", true},
+		{"legacy", map[string]string{"TFO_HOST": "https://tfo"}, "host", "https://tfo", true},
+		{"current wins", map[string]string{"IK_HOST": "https://ik", "TFO_HOST": "https://tfo"}, "host", "https://ik", true},
+		{"dashes", map[string]string{"TFO_CREDENTIALS_PASSPHRASE": "secret"}, "credentials-passphrase", "secret", true},
+		{"set empty", map[string]string{"IK_HOST": ""}, "host", "", true},
+		{"unset", nil, "host", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"IK_HOST", "TFO_HOST", "IK_CREDENTIALS_PASSPHRASE", "TFO_CREDENTIALS_PASSPHRASE"} {
+				if value, ok := tt.env[name]; ok {
+					t.Setenv(name, value)
+				} else {
+					unsetenv(t, name)
+				}
+			}
+			got, ok := lookupEnv(tt.key)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("lookupEnv(%q) = %q, %t, want %q, %t", tt.key, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestLookupEnvConcurrent(t *testing.T) {
+	t.Setenv("TFO_NAMESPACE", "default")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := getEnv("namespace"); got != "default" {
+				t.Errorf("got %q, want default", got)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/exec"
+)
+
+// Exit codes returned by ik. Codes used for ik's own failures start at 64 so
+// they can be told apart from the exit status of a remote command, which is
+// returned as is.
+const (
+	ExitOK            = 0
+	ExitError         = 1   // Unexpected error
+	ExitUsage         = 64  // Invalid flags, arguments or config
+	ExitAuth          = 65  // Missing, expired or rejected token, or failed login
+	ExitForbidden     = 66  // Authenticated but not allowed
+	ExitNotFound      = 67  // The Tf or other resource does not exist
+	ExitTimeout       = 68  // A request or the session timed out
+	ExitRemoteCommand = 70  // The remote command failed without an exit status
+	ExitInterrupted   = 130 // Interrupted with Ctrl-C
+)
+
+// Error is an error with the exit code ik should return for it.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func usageError(err error) error {
+	return &Error{Code: ExitUsage, Err: err}
+}
+
+func authError(err error) error {
+	return &Error{Code: ExitAuth, Err: err}
+}
+
+func forbiddenError(err error) error {
+	return &Error{Code: ExitForbidden, Err: err}
+}
+
+func notFoundError(err error) error {
+	return &Error{Code: ExitNotFound, Err: err}
+}
+
+func timeoutError(err error) error {
+	return &Error{Code: ExitTimeout, Err: err}
+}
+
+// interruptedError is returned by commands stopped with Ctrl-C or SIGTERM.
+func interruptedError() error {
+	return &Error{Code: ExitInterrupted, Err: errors.New("interrupted")}
+}
+
+// RemoteCommandError is returned when the command run in a debug session
+// exits non-zero. Status is 0 when the exit status is unknown.
+type RemoteCommandError struct {
+	Status int
+}
+
+func (e *RemoteCommandError) Error() string {
+	if e.Status == 0 {
+		return "remote command failed"
+	}
+	return fmt.Sprintf("remote command exited with status %d", e.Status)
+}
+
+// apiError converts an HTTP status and message returned by the API into an
+// error with the matching exit code.
+func apiError(statusCode int, message string) error {
+	err := errors.New(message)
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return authError(err)
+	case http.StatusForbidden:
+		return forbiddenError(err)
+	case http.StatusNotFound:
+		return notFoundError(err)
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return timeoutError(err)
+	}
+	return err
+}
+
+// ExitCode returns the exit code for err.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var ikErr *Error
+	if errors.As(err, &ikErr) {
+		return ikErr.Code
+	}
+
+	var remoteErr *RemoteCommandError
+	if errors.As(err, &remoteErr) {
+		if remoteErr.Status > 0 && remoteErr.Status < 256 {
+			return remoteErr.Status
+		}
+		return ExitRemoteCommand
+	}
+
+	var codeErr exec.CodeExitError
+	if errors.As(err, &codeErr) {
+		if codeErr.Code > 0 && codeErr.Code < 256 {
+			return codeErr.Code
+		}
+		return ExitRemoteCommand
+	}
+
+	switch {
+	case apierrors.IsUnauthorized(err):
+		return ExitAuth
+	case apierrors.IsForbidden(err):
+		return ExitForbidden
+	case apierrors.IsNotFound(err):
+		return ExitNotFound
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return ExitTimeout
+	case errors.Is(err, context.DeadlineExceeded):
+		return ExitTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ExitTimeout
+	}
+
+	return ExitError
+}
+
+// wrapArgsErrors marks errors from the positional argument validators of c and
+// its sub-commands as usage errors.
+func wrapArgsErrors(c *cobra.Command) {
+	if validateArgs := c.Args; validateArgs != nil {
+		c.Args = func(cmd *cobra.Command, args []string) error {
+			if err := validateArgs(cmd, args); err != nil {
+				return usageError(err)
+			}
+			return nil
+		}
+	}
+	for _, sub := range c.Commands() {
+		wrapArgsErrors(sub)
+	}
+}
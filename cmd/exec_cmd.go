@@ -1,320 +1,643 @@
 package cmd
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"net"
 	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/atotto/clipboard"
-	"github.com/eiannone/keyboard"
-	"github.com/galleybytes/infrakube-stella/pkg/api"
 	"github.com/gorilla/websocket"
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	xterm "golang.org/x/term"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 )
 
 var execCmd = &cobra.Command{
-	Use:   "exec [-c client] <tf-resource-name>",
+	Use:   "exec [-c client] <tf-resource-name> [-- command...]",
 	Short: "Launch a debug session",
-	Long:  "Create a debug pod via the API and interact via webtty",
+	Long: `Create a debug pod via the API and interact via webtty.
+
+When stdin or stdout is not a terminal, eg in CI, the command runs without a
+TTY: stdin is streamed to it, its output is written to stdout as is, and ik
+exits with its exit status.`,
 	PreRunE: func(cmd *cobra.Command, args []string) error {
-		viper.BindPFlag("host", cmd.Flags().Lookup("host"))
-		host = viper.GetString("host")
-		if host == "" {
-			return fmt.Errorf("`--host` is required")
+		o := execOpts
+		if o.Host == "" {
+			o.Host = configString("host")
+		}
+		if o.Host == "" {
+			return usageError(fmt.Errorf("`--host` is required"))
+		}
+		if o.ClientName == "" {
+			o.ClientName = configString("client")
+		}
+		if o.ClientName == "" {
+			return usageError(fmt.Errorf("`--client` is required"))
+		}
+		o.Namespace = resolveNamespace(factory)
+		o.IOStreams = genericclioptions.IOStreams{In: os.Stdin, Out: os.Stdout, ErrOut: os.Stderr}
+		if !cmd.Flags().Changed("tty") {
+			_, inTerminal := terminalFd(o.In)
+			_, outTerminal := terminalFd(o.Out)
+			o.TTY = inTerminal && outTerminal
+		}
+		if o.TTY {
+			o.Term = os.Getenv("TERM")
 		}
-		if clientName == "" {
-			return fmt.Errorf("`--client` is required")
+		if err := completeTransportOptions(cmd.Flags(), &o.Transport); err != nil {
+			return err
+		}
+		token, err := lookupToken(cmd.Context(), o.Host)
+		if err != nil {
+			return err
 		}
-		token = viper.GetString("token")
 		if token == "" {
-			return fmt.Errorf("No token was found. Try running `ik connect`")
+			return authError(fmt.Errorf("No token was found. Try running `ik connect`"))
 		}
-		return nil
+		o.Token, err = checkToken(cmd.Context(), &ConnectOptions{Host: o.Host, Transport: o.Transport, NoStdin: true}, token)
+		return err
 	},
 	Args: cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		execOpts.Name = args[0]
 		if len(args) > 1 {
-			command = args[1:]
+			execOpts.Command = args[1:]
 		}
-		TerminalWebsocket(args[0])
+		return TerminalWebsocket(cmd.Context(), execOpts)
 	},
 }
 
+// ExecOptions are the options of `ik exec`. A session only uses its options
+// and streams, so several can run in one process.
+type ExecOptions struct {
+	// Host is the URL of the API
+	Host       string
+	Token      string
+	ClientName string
+	Namespace  string
+	// Name of the Tf resource to debug
+	Name string
+	// Command to run in the debug pod instead of an interactive shell
+	Command []string
+	// TTY runs the command in a pty with the local terminal in raw mode.
+	// Without it, stdin and stdout are streamed as is.
+	TTY bool
+	// Term is the TERM of the local terminal, sent to the server with TTY
+	Term string
+	// Record is the file the session is recorded to in the asciicast v2
+	// format, nothing is recorded when it is empty
+	Record string
+	// Stats shows the round-trip latency to the server on a status line
+	Stats     bool
+	Transport TransportOptions
+
+	genericclioptions.IOStreams
+}
+
+var execOpts = &ExecOptions{}
+
 func init() {
-	execCmd.Flags().StringVarP(&host, "host", "", "", "Terraform-Operator API URL")
-	execCmd.Flags().StringVarP(&clientName, "client", "c", "", "The client identifier")
+	execCmd.Flags().StringVarP(&execOpts.Host, "host", "", "", "Infrakube API URL")
+	execCmd.Flags().StringVarP(&execOpts.ClientName, "client", "c", "", "The client identifier")
+	execCmd.Flags().BoolVarP(&execOpts.TTY, "tty", "t", false, "Run the command in a TTY, the default when stdin and stdout are terminals")
+	execCmd.Flags().StringVar(&execOpts.Record, "record", "", "Record the session to a file in the asciicast v2 format, play it with `ik replay`")
+	execCmd.Flags().BoolVar(&execOpts.Stats, "stats", false, "Show the round-trip latency to the server on a status line")
+	addTransportFlags(execCmd.Flags(), &execOpts.Transport)
+	execCmd.RegisterFlagCompletionFunc("client", completeClients)
 	rootCmd.AddCommand(execCmd)
 }
 
-func TerminalWebsocket(name string) (isDone bool) {
-	// Get the file descriptor of the terminal
-	fd := int(os.Stdout.Fd())
+// Reconnecting to a dropped session gives up after reconnectTimeout. Attempts
+// are spaced like retried requests, starting at retryBackoff up to
+// maxRetryWait.
+const reconnectTimeout = 2 * time.Minute
+
+// Pings are sent every pingInterval so load balancers don't cut idle
+// sessions. A connection the server sent nothing on, not even a pong, for
+// deadConnectionTimeout is dead.
+const (
+	pingInterval          = 15 * time.Second
+	deadConnectionTimeout = 3 * pingInterval
+)
 
-	// Create a channel to receive terminal size changes
-	sizeCh := make(chan ([2]int))
-	columns, rows, _ := xterm.GetSize(fd)
+// dialDebug opens the websocket of a debug session, or reattaches to the
+// session sessionID when it is not empty. Errors returned by the API are
+// converted to typed errors.
+func dialDebug(ctx context.Context, client *stella.Client, dialer *websocket.Dialer, o *ExecOptions, sessionID string) (*stella.DebugSession, error) {
+	client.Token = o.Token
+	r := stella.DebugRequest{
+		ClientName: o.ClientName,
+		Namespace:  o.Namespace,
+		Name:       o.Name,
+		Command:    o.Command,
+		NoTTY:      !o.TTY,
+		SessionID:  sessionID,
+	}
+	if o.TTY {
+		r.Term = o.Term
+	}
+	session, err := client.DialDebug(ctx, dialer, r)
+	if err != nil {
+		return nil, stellaError(err)
+	}
+	return session, nil
+}
 
-	// Create a signal handler for SIGWINCH
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGWINCH)
+// TerminalWebsocket runs a debug session over the API's websocket with the
+// streams of o. With o.TTY the local terminal, when the streams are one, is
+// put in raw mode and resized with the remote pty, otherwise the streams are
+// copied as is. A non-zero exit status of
+// the remote command is returned as a *RemoteCommandError. When the
+// connection drops, ik reattaches to the session if the server supports it.
+func TerminalWebsocket(ctx context.Context, o *ExecOptions) error {
+	// Create a channel to receive terminal size changes, it stays nil without
+	// a TTY
+	var sizeCh chan [2]int
+	var columns, rows int
+	if o.TTY {
+		// Get the file descriptor of the terminal, the size stays 0 when
+		// the output is not one
+		fd, isTerminal := terminalFd(o.Out)
+		sizeCh = make(chan [2]int, 1)
+		if isTerminal {
+			columns, rows, _ = xterm.GetSize(fd)
+		}
 
-	// Run a goroutine to listen for signals and send the new size to the channel
-	go func() {
-		sizeCh <- [2]int{columns, rows}
-		for range sigCh {
-			columns, rows, err := xterm.GetSize(fd)
-			if err == nil {
-				sizeCh <- [2]int{columns, rows}
-			}
+		// Create a signal handler for SIGWINCH
+		sigCh := make(chan os.Signal, 1)
+		if isTerminal {
+			signal.Notify(sigCh, syscall.SIGWINCH)
+			defer signal.Stop(sigCh)
 		}
-	}()
-	// isKeyboardSet := false
 
-	isDone = true
+		// Run a goroutine to listen for signals and send the new size to the
+		// channel until the session ends
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			send := func(columns, rows int) bool {
+				select {
+				case sizeCh <- [2]int{columns, rows}:
+					return true
+				case <-done:
+					return false
+				}
+			}
+			if !send(columns, rows) {
+				return
+			}
+			for {
+				select {
+				case <-sigCh:
+					columns, rows, err := xterm.GetSize(fd)
+					if err == nil && !send(columns, rows) {
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
 
-	URL, err := url.Parse(host)
+	URL, err := url.Parse(o.Host)
+	if err != nil {
+		return usageError(fmt.Errorf("invalid URL: %s", err))
+	}
+	client, err := newStellaClient(o.Host, &o.Transport)
 	if err != nil {
-		log.Fatal("Invalid URL", err)
+		return err
 	}
 
-	scheme := "ws"
-	if URL.Scheme == "https" {
-		scheme = "wss"
+	if o.TTY {
+		logger := log.New(o.ErrOut, "", log.LstdFlags)
+		logger.Printf("-Connection Info-\n")
+		logger.Printf("Host: %s\n", URL.Host)
+		logger.Printf("Client: %s\n", o.ClientName)
+		logger.Printf("Namespace: %s\n", o.Namespace)
+		logger.Printf("Name: %s\n", o.Name)
 	}
 
-	wsURL := fmt.Sprintf("%s://%s/api/v1/cluster/%s/debug/%s/%s", scheme, URL.Host, clientName, namespace, name)
-	if len(command) > 0 {
-		query := ""
-		for _, i := range command {
-			if query != "" {
-				query += "&"
-			}
-			query += url.PathEscape(fmt.Sprintf("command=%s", i))
+	dialer, err := newWebsocketDialer(&o.Transport)
+	if err != nil {
+		return err
+	}
+	session, err := dialDebug(ctx, client, dialer, o, "")
+	if ExitCode(err) == ExitAuth {
+		// The token was rejected, get a new one and try once more
+		token, authErr := reauthenticate(ctx, &ConnectOptions{Host: o.Host, Transport: o.Transport, NoStdin: true})
+		if authErr != nil {
+			return authErr
 		}
-		wsURL += fmt.Sprintf("?%s", query)
+		o.Token = token
+		session, err = dialDebug(ctx, client, dialer, o, "")
 	}
-	headers := http.Header{
-		"Token": {token},
+	if err != nil {
+		return err
 	}
+	// session changes when ik reconnects
+	defer func() {
+		session.Close()
+	}()
 
-	log.Printf("-Connection Info-\n")
-	log.Printf("Host: %s\n", URL.Host)
-	log.Printf("Client: %s\n", clientName)
-	log.Printf("Namespace: %s\n", namespace)
-	log.Printf("Name: %s\n", name)
-
-	dialer := websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	conn, resp, err := dialer.Dial(wsURL, headers)
-	if err != nil && resp != nil {
-
-		defer resp.Body.Close()
-		data, _ := io.ReadAll(resp.Body)
-		var apiResponse api.Response
-		err = json.Unmarshal(data, &apiResponse)
-		if err != nil {
-			log.Fatal(err)
+	// The status line of --stats stays nil without a TTY, the stats are
+	// printed instead
+	var status *statusLine
+	if o.Stats && o.TTY {
+		status = &statusLine{out: o.ErrOut}
+	}
+	// sessionSize returns the size of the remote pty in a terminal of size
+	sessionSize := func(size [2]int) [2]int {
+		if status != nil && size[1] > 1 {
+			size[1]--
 		}
-		log.Fatal(apiResponse.StatusInfo.Message)
+		return size
+	}
 
-	} else if err != nil {
-		log.Fatal(err)
+	// The recorder stays nil when the session is not recorded
+	var rec *recorder
+	if o.Record != "" {
+		remoteSize := sessionSize([2]int{columns, rows})
+		columns, rows := remoteSize[0], remoteSize[1]
+		rec, err = newRecorder(o.Record, columns, rows, fmt.Sprintf("ik exec %s/%s", o.Namespace, o.Name))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := rec.Close(); err != nil {
+				fmt.Fprintf(o.ErrOut, "warning: %s\n", err)
+			}
+		}()
 	}
-	defer conn.Close()
 
-	// Create a channel for interrupt signal
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	// Start a goroutine to read messages from the WebSocket connection
+	pongs := make(chan time.Time, 1)
+	closer := readSession(session.Conn, o.Out, o.ErrOut, rec, pongs)
 
-	// Create a channel for closer signal
-	closer := make(chan error)
+	if stdinFd, isTerminal := terminalFd(o.In); o.TTY && isTerminal {
+		// Forward the keys as typed, like `ik local debug`. The remote pty
+		// handles Ctrl-C, line editing and echo.
+		state, err := xterm.MakeRaw(stdinFd)
+		if err != nil {
+			return err
+		}
+		defer xterm.Restore(stdinFd, state)
+	}
+	if status != nil {
+		// The line is drawn once the size of the terminal is received
+		defer status.close()
+	}
 
-	// Start a goroutine to read messages from the WebSocket connection
+	// Stdin is read in a goroutine and written to the websocket by the loop
+	// below, which owns all writes to the connection. A nil input means stdin
+	// was closed.
+	done := make(chan struct{})
+	defer close(done)
+	inputCh := make(chan []byte)
 	go func() {
-		defer close(closer)
+		buf := make([]byte, 32*1024)
 		for {
-			// Read a message
-			mt, bmsg, err := conn.ReadMessage()
-			if err != nil {
-				if strings.Contains(err.Error(), "close 1000") {
-					closer <- nil
+			n, err := o.In.Read(buf)
+			if n > 0 {
+				input := make([]byte, n)
+				copy(input, buf[:n])
+				select {
+				case inputCh <- input:
+				case <-done:
+					return
 				}
-				closer <- err
-				return
 			}
-			switch mt {
-			case websocket.TextMessage:
-				msg := string(bmsg)
-				if strings.HasPrefix(msg, "2") {
-					// log.Println("PONG!")
-					continue
-				}
-				if strings.HasPrefix(msg, "3") {
-					continue
-				}
-				if strings.HasPrefix(msg, "6") {
-					continue
-				}
-				dec, err := base64.StdEncoding.DecodeString(string(msg[1:]))
-				if err != nil {
-					log.Println(err)
-					continue
+			if err != nil {
+				select {
+				case inputCh <- nil:
+				case <-done:
 				}
-				fmt.Printf("%s", string(dec))
-			case websocket.CloseMessage:
-				return
-			default:
-				fmt.Printf("The MessageType: %+v\n", mt)
-				// Print the message to the standard output
-				fmt.Printf("Received: %s\n", bmsg)
 				return
 			}
-
 		}
 	}()
 
-	keyEvent, err := keyboard.GetKeys(128)
-	if err != nil {
-		log.Panic(err)
+	// Messages that couldn't be written because the connection dropped, they
+	// are sent again once ik has reconnected
+	var unsent []sessionMessage
+	send := func(m sessionMessage) error {
+		if len(unsent) == 0 {
+			err := writeMessage(session.Conn, m.Type, m.Payload)
+			if err == nil {
+				return nil
+			}
+			if session.ID == "" {
+				return fmt.Errorf("write: %w", err)
+			}
+			// The reader sees the connection is gone and reconnects
+			session.Close()
+		}
+		unsent = append(unsent, m)
+		return nil
 	}
-	defer func() {
-		_ = keyboard.Close()
-	}()
 
-	var ctrlCExit bool
-	for {
+	stats := &sessionStats{}
+	ping := func() error {
+		stats.ping(time.Now())
+		return send(sessionMessage{stella.MessagePing, nil})
+	}
+	if err := ping(); err != nil {
+		return err
+	}
+	if status != nil {
+		status.set(stats.String())
+	}
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
 
+	// Size of the terminal, sent again after reconnecting
+	var size [2]int
+	for {
 		select {
-		case size := <-sizeCh:
+		case newSize := <-sizeCh:
+			if newSize[0] <= 0 || newSize[1] <= 0 {
+				// The size is unknown with `--tty` when stdout is not a
+				// terminal, the remote pty keeps its default size
+				continue
+			}
+			size = newSize
+			if status != nil {
+				status.resize(size[0], size[1])
+			}
+			remoteSize := sessionSize(size)
+			if err := send(resizeMessage(remoteSize)); err != nil {
+				return err
+			}
+			if rec != nil {
+				rec.Resize(remoteSize[0], remoteSize[1])
+			}
 
-			sizeJSON := fmt.Sprintf(`{"Columns": %d, "Rows": %d}`, size[0], size[1])
-			encodedSizeJSON := base64.StdEncoding.EncodeToString([]byte(sizeJSON))
-			// log.Println("Will set size", sizeJSON)
-			err := conn.WriteMessage(websocket.TextMessage, append([]byte{byte('3')}, []byte(encodedSizeJSON)...))
-			// err := conn.WriteMessage(websocket.TextMessage, []byte{byte('2')})
-			if err != nil {
-				log.Println("there was some error:", err)
+		case <-pingTicker.C:
+			if err := ping(); err != nil {
+				return err
+			}
+
+		case received := <-pongs:
+			if !stats.pong(received) || !o.Stats {
+				continue
+			}
+			if status != nil {
+				status.set(stats.String())
+			} else {
+				fmt.Fprintln(o.ErrOut, stats)
 			}
-			continue
 
 		case err := <-closer:
-			if err != nil {
-				log.Fatal(err)
+			if session.ID == "" || !isDropped(err) {
+				return sessionError(err)
 			}
-			return
-		case <-interrupt:
-			// Send a close message to the WebSocket server
-			log.Println("interrupt")
-			err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			session.Close()
+			session, err = reconnectSession(ctx, client, dialer, o, session.ID, err)
 			if err != nil {
-				log.Println("write close:", err)
-				return
+				return err
 			}
-			// Wait for the server to close the connection
-			select {
-			case <-closer:
-			case <-time.After(time.Second):
+			closer = readSession(session.Conn, o.Out, o.ErrOut, rec, pongs)
+			messages := unsent
+			unsent = nil
+			if o.TTY && size != [2]int{} {
+				messages = append([]sessionMessage{resizeMessage(sessionSize(size))}, messages...)
+			}
+			for _, m := range messages {
+				if err := send(m); err != nil {
+					return err
+				}
+			}
+			if status != nil {
+				// The status line may have been scrolled away by the
+				// reconnect messages
+				status.resize(size[0], size[1])
+			}
+			if err := ping(); err != nil {
+				return err
 			}
-			return
-
-		case ev := <-keyEvent:
 
-			// fmt.Printf("`")
+		case <-ctx.Done():
+			// Ctrl-C when it is not sent to the remote shell, or SIGTERM
+			return closeSession(session.Conn, closer)
 
-			if ctrlCExit {
-				fmt.Fprintf(os.Stderr, "\nPress ctrl-c again to exit session\n")
+		case input := <-inputCh:
+			if input == nil {
+				inputCh = nil
+				if o.TTY {
+					continue
+				}
+				// Let the remote command see the end of its input
+				if err := send(sessionMessage{stella.MessageEOF, nil}); err != nil {
+					return err
+				}
+				continue
 			}
+			if err := send(sessionMessage{stella.MessageInput, input}); err != nil {
+				return err
+			}
+			if rec != nil {
+				rec.Input(input)
+			}
+		}
+	}
+}
 
-			char, key, err := ev.Rune, ev.Key, ev.Err
+// sessionMessage is a message written to the websocket of a debug session
+type sessionMessage struct {
+	Type    byte
+	Payload []byte
+}
+
+// resizeMessage returns the message that resizes the remote pty to size.
+func resizeMessage(size [2]int) sessionMessage {
+	sizeJSON := fmt.Sprintf(`{"Columns": %d, "Rows": %d}`, size[0], size[1])
+	return sessionMessage{stella.MessageResize, []byte(sizeJSON)}
+}
+
+// readSession starts a goroutine that writes the output of the session to
+// out, and to rec when it is not nil, until the connection ends. Anything
+// else the server sends is reported on errOut. The time
+// pongs are received at is sent on pongs when it is not full. The error that
+// ended the session is sent on the returned channel, which is closed
+// afterwards. The close frame of the server is read as a *websocket.CloseError
+// with the exit status in its text.
+func readSession(conn *websocket.Conn, out, errOut io.Writer, rec *recorder, pongs chan<- time.Time) <-chan error {
+	closer := make(chan error, 1)
+	go func() {
+		defer close(closer)
+		for {
+			// The server answers the pings, a connection without any message
+			// for longer is dead
+			conn.SetReadDeadline(time.Now().Add(deadConnectionTimeout))
+			// Read a message
+			mt, bmsg, err := conn.ReadMessage()
 			if err != nil {
-				panic(err)
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					err = timeoutError(fmt.Errorf("the connection to the server is dead, nothing was received for %s: %w", deadConnectionTimeout, err))
+				}
+				closer <- err
+				return
 			}
-
-			if key == keyboard.KeyCtrlC {
-				if ctrlCExit {
-					err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-					if err != nil {
-						log.Println("write close:", err)
-						return
+			switch mt {
+			case websocket.TextMessage:
+				if len(bmsg) > 0 && bmsg[0] == stella.MessagePong {
+					select {
+					case pongs <- time.Now():
+					default:
 					}
+					continue
 				}
-				ctrlCExit = false // Set to true - useful for debugging
-			} else {
-				ctrlCExit = false
+				if len(bmsg) == 0 || bmsg[0] != stella.MessageOutput {
+					// Messages for the browser's terminal
+					continue
+				}
+				dec, err := base64.StdEncoding.DecodeString(string(bmsg[1:]))
+				if err != nil {
+					fmt.Fprintf(errOut, "invalid output message: %s\r\n", err)
+					continue
+				}
+				if rec != nil {
+					rec.Output(dec)
+				}
+				out.Write(dec)
+			default:
+				// Stdout may be the output of the remote command, keep
+				// anything else on stderr. The terminal may be in raw mode,
+				// lines need a carriage return.
+				fmt.Fprintf(errOut, "The MessageType: %+v\r\n", mt)
+				fmt.Fprintf(errOut, "Received: %s\r\n", bmsg)
+				return
 			}
 
-			// fmt.Printf("%c", char)
-
-			var byteArr []byte
-			if key != 0 {
-				// TODO Arrow keys and special keys might depend on the "term" type. For example,
-				// arrows do not work properly in a "screen" term. Fix special characters based
-				// on the term type.
-				switch key {
-				case keyboard.KeyArrowUp:
-					byteArr = []byte{27, 91, 65}
-				case keyboard.KeyArrowDown:
-					byteArr = []byte{27, 91, 66}
-				case keyboard.KeyArrowLeft:
-					byteArr = []byte{27, 91, 68}
-				case keyboard.KeyArrowRight:
-					byteArr = []byte{27, 91, 67}
-				case keyboard.KeyEsc:
-					if char > 0 {
-						data, err := clipboard.ReadAll()
-						if err == nil {
-							byteArr = []byte(data)
-						} else {
-							byteArr = []byte{byte(key)}
-						}
-
-					} else {
-						byteArr = []byte{byte(key)}
-					}
-				default:
-					byteArr = []byte{byte(key)}
-				}
-				// log.Println("I pressed", char, "key", key, "byte", byteArr, "string", string(byteArr))
+		}
+	}()
+	return closer
+}
 
-			} else {
-				byteArr = []byte{byte(char)}
-			}
+// isDropped reports whether err, returned by reading the websocket, means the
+// connection was lost rather than closed by the server.
+func isDropped(err error) bool {
+	if websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
 
-			// log.Println("I pressed", char, "key", key, "byte", byteArr, "string", string(byteArr))
-			// fmt.Printf("%s", string(byteArr))
-			encodedText := base64.StdEncoding.EncodeToString(byteArr)
+// reconnectSession reattaches to the debug session sessionID after its
+// connection dropped with cause. It retries with backoff for up to
+// reconnectTimeout and shows its progress on a status line.
+func reconnectSession(ctx context.Context, client *stella.Client, dialer *websocket.Dialer, o *ExecOptions, sessionID string, cause error) (*stella.DebugSession, error) {
+	status := func(format string, a ...interface{}) {
+		if o.TTY {
+			// Overwrite the status line, the terminal is in raw mode
+			fmt.Fprintf(o.ErrOut, "\r\x1b[K"+format, a...)
+		} else {
+			fmt.Fprintf(o.ErrOut, format+"\n", a...)
+		}
+	}
+	clearStatus := func() {
+		if o.TTY {
+			fmt.Fprint(o.ErrOut, "\r\x1b[K")
+		}
+	}
 
-			if key == keyboard.KeyHome {
-				log.Println("I pressed the home key")
-				err := conn.WriteMessage(websocket.TextMessage, []byte{byte('2')})
-				if err != nil {
-					log.Println(err)
-				}
-				continue
+	status("Connection lost (%s), reconnecting", cause)
+	deadline := time.Now().Add(reconnectTimeout)
+	wait := retryBackoff
+	for attempt := 1; ; attempt++ {
+		session, err := dialDebug(ctx, client, dialer, o, sessionID)
+		if err == nil {
+			status("Reconnected")
+			if o.TTY {
+				fmt.Fprint(o.ErrOut, "\r\n")
 			}
-
-			wstext := "1" + encodedText
-			_ = wstext
-			// Write a text message to the WebSocket connection
-			erre := conn.WriteMessage(websocket.TextMessage, []byte(wstext))
-			if erre != nil {
-				log.Println("write:", erre)
-				return
+			if session.ID == "" {
+				session.ID = sessionID
 			}
+			return session, nil
+		}
+		switch ExitCode(err) {
+		case ExitUsage, ExitAuth, ExitForbidden, ExitNotFound:
+			// Retrying won't help, eg the session ended in the meantime
+			clearStatus()
+			return nil, fmt.Errorf("failed to reconnect to the session: %w", err)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if time.Now().Add(wait).After(deadline) {
+			clearStatus()
+			return nil, fmt.Errorf("failed to reconnect to the session within %s: %w", reconnectTimeout, err)
+		}
+
+		status("Connection lost, reconnecting in %s (attempt %d failed: %s)", wait, attempt, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+	}
+}
+
+// writeMessage writes a message of type messageType with the base64 encoded
+// payload to the websocket of a debug session.
+func writeMessage(conn *websocket.Conn, messageType byte, payload []byte) error {
+	message := append([]byte{messageType}, base64.StdEncoding.EncodeToString(payload)...)
+	return conn.WriteMessage(websocket.TextMessage, message)
+}
 
+// sessionError converts the error that ended a debug session into the error
+// returned by ik. A normal closure ends the session successfully unless the
+// server reported a non-zero exit status.
+func sessionError(err error) error {
+	if status, ok := stella.ExitStatus(err); ok {
+		if status != 0 {
+			return &RemoteCommandError{Status: status}
 		}
+		return nil
+	}
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return nil
 	}
+	return err
+}
 
+// closeSession asks the server to end the session after ik was interrupted
+// and waits briefly for it to close the connection.
+func closeSession(conn *websocket.Conn, closer <-chan error) error {
+	err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		return fmt.Errorf("write close: %w", err)
+	}
+	select {
+	case <-closer:
+	case <-time.After(time.Second):
+	}
+	return interruptedError()
+}
+
+// terminalFd returns the file descriptor of stream and whether it is a
+// terminal. Streams other than files, eg buffers, are never terminals.
+func terminalFd(stream interface{}) (int, bool) {
+	f, ok := stream.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, false
+	}
+	fd := int(f.Fd())
+	return fd, xterm.IsTerminal(fd)
 }
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// newDebugServer returns a server for debug sessions of the Tfs in exitStatus,
+// with a pty when tty is set. The input of a session is echoed back prefixed
+// with the name of the Tf, as are resizes, and the session ends with the exit
+// status of the Tf once its stdin is closed.
+func newDebugServer(t *testing.T, exitStatus map[string]int, tty bool) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		status, ok := exitStatus[name]
+		if !ok {
+			http.Error(w, "tf not found", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Token") != "secret" || (r.URL.Query().Get("tty") != "false") != tty {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil || len(message) == 0 {
+				return
+			}
+			switch message[0] {
+			case stella.MessagePing:
+				err = conn.WriteMessage(websocket.TextMessage, []byte{stella.MessagePong})
+			case stella.MessageInput:
+				input, _ := base64.StdEncoding.DecodeString(string(message[1:]))
+				err = writeMessage(conn, stella.MessageOutput, []byte(name+": "+string(input)))
+			case stella.MessageResize:
+				size, _ := base64.StdEncoding.DecodeString(string(message[1:]))
+				err = writeMessage(conn, stella.MessageOutput, []byte(name+": resize "+string(size)+"\n"))
+			case stella.MessageEOF:
+				reason := fmt.Sprintf("exit status %d", status)
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTerminalWebsocketConcurrentSessions(t *testing.T) {
+	exitStatus := map[string]int{"vpc": 0, "dns": 3}
+	server := newDebugServer(t, exitStatus, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := map[string]error{}
+	outs := map[string]*bytes.Buffer{}
+	var mu sync.Mutex
+	for name := range exitStatus {
+		out := &bytes.Buffer{}
+		outs[name] = out
+		o := &ExecOptions{
+			Host:       server.URL,
+			Token:      "secret",
+			ClientName: "prod",
+			Namespace:  "default",
+			Name:       name,
+			Command:    []string{"cat"},
+			IOStreams: genericclioptions.IOStreams{
+				In:     strings.NewReader("hello " + name + "\n"),
+				Out:    out,
+				ErrOut: &bytes.Buffer{},
+			},
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := TerminalWebsocket(ctx, o)
+			mu.Lock()
+			errs[name] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for name, status := range exitStatus {
+		if got, want := outs[name].String(), name+": hello "+name+"\n"; got != want {
+			t.Errorf("%s: got output %q, want %q", name, got, want)
+		}
+		err := errs[name]
+		if status == 0 {
+			if err != nil {
+				t.Errorf("%s: got %v, want no error", name, err)
+			}
+			continue
+		}
+		var remoteErr *RemoteCommandError
+		if !errors.As(err, &remoteErr) || ExitCode(err) != status {
+			t.Errorf("%s: got %v, want exit status %d", name, err, status)
+		}
+	}
+}
+
+func TestTerminalWebsocketNotFound(t *testing.T) {
+	server := newDebugServer(t, map[string]int{"vpc": 0}, false)
+	var out, errOut bytes.Buffer
+	o := &ExecOptions{
+		Host:       server.URL,
+		Token:      "secret",
+		ClientName: "prod",
+		Namespace:  "default",
+		Name:       "other",
+		IOStreams:  genericclioptions.IOStreams{In: strings.NewReader(""), Out: &out, ErrOut: &errOut},
+	}
+	err := TerminalWebsocket(context.Background(), o)
+	if ExitCode(err) != ExitNotFound {
+		t.Fatalf("got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitNotFound)
+	}
+	if out.Len() != 0 {
+		t.Errorf("got output %q, want none", out.String())
+	}
+}
+
+func TestTerminalWebsocketTTYWithoutTerminal(t *testing.T) {
+	server := newDebugServer(t, map[string]int{"vpc": 0}, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outReader, outWriter := io.Pipe()
+	o := &ExecOptions{
+		Host:       server.URL,
+		Token:      "secret",
+		ClientName: "prod",
+		Namespace:  "default",
+		Name:       "vpc",
+		TTY:        true,
+		IOStreams:  genericclioptions.IOStreams{In: strings.NewReader("hello\n"), Out: outWriter, ErrOut: &bytes.Buffer{}},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- TerminalWebsocket(ctx, o)
+		outWriter.Close()
+	}()
+
+	out := bufio.NewReader(outReader)
+	line, err := out.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "vpc: hello\n" {
+		t.Errorf("got output %q, want %q", line, "vpc: hello\n")
+	}
+	// A session with a pty only ends when ik is interrupted
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	rest, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) > 0 {
+		t.Errorf("got output %q, want no resize of an unknown size", rest)
+	}
+	if err := <-errCh; ExitCode(err) != ExitInterrupted {
+		t.Errorf("got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitInterrupted)
+	}
+}
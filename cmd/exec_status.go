@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// statusLine draws a line of text on the last row of the terminal, below the
+// debug session of `ik exec --stats`. The rows above it are a scrolling
+// region so the output of the session doesn't overwrite it, and the remote
+// pty is one row shorter than the terminal.
+type statusLine struct {
+	// out is the terminal the line is drawn on
+	out           io.Writer
+	columns, rows int
+	text          string
+}
+
+// resize reserves the last row of a terminal of columns by rows for the
+// status line and draws it again.
+func (s *statusLine) resize(columns, rows int) {
+	s.columns, s.rows = columns, rows
+	if rows < 2 {
+		return
+	}
+	// Scroll the cursor off the last row when it is on it, then limit the
+	// scrolling region. Setting the region moves the cursor, it is saved
+	// and restored around it.
+	fmt.Fprintf(s.out, "\n\x1b[A\x1b7\x1b[1;%dr\x1b8", rows-1)
+	s.draw()
+}
+
+// set replaces the text of the status line.
+func (s *statusLine) set(text string) {
+	s.text = text
+	s.draw()
+}
+
+func (s *statusLine) draw() {
+	if s.rows < 2 {
+		return
+	}
+	text := s.text
+	if len(text) > s.columns {
+		text = text[:s.columns]
+	}
+	fmt.Fprintf(s.out, "\x1b7\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m\x1b8", s.rows, text)
+}
+
+// close clears the status line and gives the whole terminal back.
+func (s *statusLine) close() {
+	if s.rows < 2 {
+		return
+	}
+	fmt.Fprintf(s.out, "\x1b7\x1b[r\x1b[%d;1H\x1b[2K\x1b8", s.rows)
+}
+
+// sessionStats tracks the round-trip latency of the pings sent to the server.
+type sessionStats struct {
+	// Time the last ping was sent, zero once its pong was received
+	pingSent time.Time
+	last     time.Duration
+	total    time.Duration
+	pongs    int
+}
+
+func (s *sessionStats) ping(now time.Time) {
+	s.pingSent = now
+}
+
+// pong records the pong received at now. Pongs without an outstanding ping
+// are ignored.
+func (s *sessionStats) pong(now time.Time) bool {
+	if s.pingSent.IsZero() {
+		return false
+	}
+	s.last = now.Sub(s.pingSent)
+	s.total += s.last
+	s.pongs++
+	s.pingSent = time.Time{}
+	return true
+}
+
+func (s *sessionStats) String() string {
+	if s.pongs == 0 {
+		return "ik: waiting for the server"
+	}
+	return fmt.Sprintf("ik: round-trip %s, average %s", s.last.Round(time.Millisecond), (s.total / time.Duration(s.pongs)).Round(time.Millisecond))
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	infrakube "github.com/galleybytes/infrakube/pkg/client/clientset/versioned"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
+	"k8s.io/client-go/rest"
+)
+
+// Factory builds the clients used by commands. Clients are only created the
+// first time they are requested, so commands that don't talk to a cluster
+// never load the kubeconfig. Implementations must be safe for concurrent use.
+type Factory interface {
+	// Namespace returns the namespace of the kubeconfig's current context
+	Namespace() (string, error)
+	RESTConfig() (*rest.Config, error)
+	KubernetesClientSet() (kubernetes.Interface, error)
+	InfrakubeClientSet() (infrakube.Interface, error)
+}
+
+type factoryImpl struct {
+	getter genericclioptions.RESTClientGetter
+
+	once               sync.Once
+	config             *rest.Config
+	clientset          kubernetes.Interface
+	infrakubeclientset infrakube.Interface
+	err                error
+}
+
+// NewFactory returns a Factory that builds clients from getter, eg
+// genericclioptions.NewConfigFlags(true).
+func NewFactory(getter genericclioptions.RESTClientGetter) Factory {
+	return &factoryImpl{getter: getter}
+}
+
+func (f *factoryImpl) init() error {
+	f.once.Do(func() {
+		config, err := f.getter.ToRESTConfig()
+		if err != nil {
+			f.err = usageError(fmt.Errorf("KUBECONFIG is not valid: %s", err))
+			return
+		}
+		// Retry throttled requests, other failures are left to client-go
+		config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &retryTransport{next: rt, throttledOnly: true}
+		})
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			f.err = err
+			return
+		}
+		infrakubeclientset, err := infrakube.NewForConfig(config)
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.config = config
+		f.clientset = clientset
+		f.infrakubeclientset = infrakubeclientset
+	})
+	return f.err
+}
+
+func (f *factoryImpl) Namespace() (string, error) {
+	namespace, _, err := f.getter.ToRawKubeConfigLoader().Namespace()
+	return namespace, err
+}
+
+func (f *factoryImpl) RESTConfig() (*rest.Config, error) {
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f.config, nil
+}
+
+func (f *factoryImpl) KubernetesClientSet() (kubernetes.Interface, error) {
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f.clientset, nil
+}
+
+func (f *factoryImpl) InfrakubeClientSet() (infrakube.Interface, error) {
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	return f.infrakubeclientset, nil
+}
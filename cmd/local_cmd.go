@@ -1,6 +1,9 @@
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
 
 var (
 	localCmd = &cobra.Command{
@@ -9,8 +12,17 @@ var (
 		Short:   "Use ik with a local kubeconfig",
 		Args:    cobra.MaximumNArgs(0),
 	}
+
+	// kubectl compatible flags used to build the cluster connection of local
+	// commands, eg --kubeconfig, --context, --as and --server
+	kubeConfigFlags = genericclioptions.NewConfigFlags(true)
 )
 
 func init() {
+	// The namespace and request timeout flags are shared by all commands and
+	// defined on rootCmd. The other flags are added by setupCommands since they
+	// are global when ik runs as a kubectl plugin.
+	kubeConfigFlags.Namespace = nil
+	kubeConfigFlags.Timeout = nil
 	rootCmd.AddCommand(localCmd)
 }
@@ -3,8 +3,8 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
+	"time"
 
 	tfv1beta1 "github.com/galleybytes/infrakube/pkg/apis/infra3/v1"
 	"github.com/spf13/cobra"
@@ -12,6 +12,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/kubectl/pkg/cmd/exec"
 	"k8s.io/kubectl/pkg/scheme"
@@ -22,53 +24,107 @@ var debugCmd = &cobra.Command{
 	Short: "Debug a tf workflow by exec into a session",
 	// 		Long: ``,
 	// Args: cobra.MaximumNArgs(1),
-	Args: cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		name := args[0]
+	Args:              cobra.MinimumNArgs(1),
+	ValidArgsFunction: completeTfNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		o := &DebugOptions{
+			Factory:        factory,
+			Namespace:      resolveNamespace(factory),
+			Name:           args[0],
+			Record:         debugRecord,
+			RequestTimeout: requestTimeout,
+			IOStreams:      genericclioptions.IOStreams{In: os.Stdin, Out: os.Stdout, ErrOut: os.Stderr},
+		}
 		if len(args) > 1 {
-			command = args[1:]
+			o.Command = args[1:]
 		}
-		debug(name)
+		return o.Run(cmd.Context())
 	},
 }
 
+var debugRecord string
+
 func init() {
+	debugCmd.Flags().StringVar(&debugRecord, "record", "", "Record the session to a file in the asciicast v2 format, play it with `ik replay`")
 	localCmd.AddCommand(debugCmd)
 }
 
-func debug(name string) {
-	if session.clientset == nil {
-		log.Fatal("KUBECONFIG is not valid")
+// DebugOptions are the options of `ik local debug`
+type DebugOptions struct {
+	Factory   Factory
+	Namespace string
+	// Name of the Tf resource to debug
+	Name string
+	// Command to run in the debug pod instead of an interactive shell
+	Command []string
+	// Record is the file the session is recorded to in the asciicast v2
+	// format, nothing is recorded when it is empty
+	Record string
+	// RequestTimeout limits each request to the cluster, 0 waits forever
+	RequestTimeout time.Duration
+
+	genericclioptions.IOStreams
+}
+
+// Run creates a debug pod for the Tf, attaches to it and deletes the pod when
+// the session ends.
+func (o *DebugOptions) Run(ctx context.Context) error {
+	clientset, err := o.Factory.KubernetesClientSet()
+	if err != nil {
+		return err
 	}
-	if session.infrakubeclientset == nil {
-		log.Fatal("Cluster does not have Terraforms resource")
+	config, err := o.Factory.RESTConfig()
+	if err != nil {
+		return err
+	}
+	pod, err := o.startPod(ctx)
+	if pod != nil {
+		defer o.deletePod(pod)
+	}
+	if err != nil {
+		return err
 	}
-	tfClient := session.infrakubeclientset.Infra3V1().Tfs(session.namespace)
-	podClient := session.clientset.CoreV1().Pods(session.namespace)
+	return o.attach(ctx, clientset, config, pod)
+}
+
+// startPod creates the debug pod of the Tf and waits until it is ready. The
+// pod is returned once it was created, even when waiting for it failed, so
+// it can be deleted.
+func (o *DebugOptions) startPod(ctx context.Context) (*corev1.Pod, error) {
+	clientset, err := o.Factory.KubernetesClientSet()
+	if err != nil {
+		return nil, err
+	}
+	infrakubeclientset, err := o.Factory.InfrakubeClientSet()
+	if err != nil {
+		return nil, err
+	}
+	tfClient := infrakubeclientset.Infra3V1().Tfs(o.Namespace)
+	podClient := clientset.CoreV1().Pods(o.Namespace)
 
-	tf, err := tfClient.Get(context.TODO(), name, metav1.GetOptions{})
+	requestCtx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+	tf, err := tfClient.Get(requestCtx, o.Name, metav1.GetOptions{})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	pod := generatePod(tf)
-	pod, err = podClient.Create(context.TODO(), pod, metav1.CreateOptions{})
+	pod, err := podClient.Create(requestCtx, generatePod(tf), metav1.CreateOptions{})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer podClient.Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
 
-	fmt.Printf("Connecting to %s ", pod.Name)
+	fmt.Fprintf(o.Out, "Connecting to %s ", pod.Name)
 
-	watcher, err := podClient.Watch(context.TODO(), metav1.ListOptions{
+	watcher, err := podClient.Watch(ctx, metav1.ListOptions{
 		FieldSelector: "metadata.name=" + pod.Name,
 	})
 	if err != nil {
-		log.Fatal(err)
+		return pod, err
 	}
 
 	for event := range watcher.ResultChan() {
-		fmt.Printf(".")
+		fmt.Fprintf(o.Out, ".")
 		switch event.Type {
 		case watch.Modified:
 			pod = event.Object.(*corev1.Pod)
@@ -85,9 +141,25 @@ func debug(name string) {
 			// fmt.Fprintln(os.Stderr, event.Type)
 		}
 	}
-	ioStreams := genericclioptions.IOStreams{In: os.Stdin, Out: os.Stdout, ErrOut: os.Stderr}
+	return pod, nil
+}
+
+// deletePod deletes the debug pod, even when the session was interrupted.
+func (o *DebugOptions) deletePod(pod *corev1.Pod) {
+	clientset, err := o.Factory.KubernetesClientSet()
+	if err != nil {
+		return
+	}
+	deleteCtx, cancel := withRequestTimeout(context.Background(), o.RequestTimeout)
+	defer cancel()
+	clientset.CoreV1().Pods(pod.Namespace).Delete(deleteCtx, pod.Name, metav1.DeleteOptions{})
+}
+
+// attach runs the command of the session in the debug pod with the streams
+// of o.
+func (o *DebugOptions) attach(ctx context.Context, clientset kubernetes.Interface, config *rest.Config, pod *corev1.Pod) error {
 	streamOptions := exec.StreamOptions{
-		IOStreams: ioStreams,
+		IOStreams: o.IOStreams,
 		Stdin:     true,
 		TTY:       true,
 	}
@@ -103,6 +175,31 @@ func debug(name string) {
 		streamOptions.ErrOut = nil
 	}
 
+	in, out, errOut := streamOptions.In, streamOptions.Out, streamOptions.ErrOut
+	if o.Record != "" {
+		var width, height int
+		if size := t.GetSize(); size != nil {
+			width, height = int(size.Width), int(size.Height)
+		}
+		rec, err := newRecorder(o.Record, width, height, fmt.Sprintf("ik local debug %s/%s", o.Namespace, o.Name))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := rec.Close(); err != nil {
+				fmt.Fprintf(o.ErrOut, "warning: %s\n", err)
+			}
+		}()
+		in = &recordReader{In: in, recorder: rec}
+		out = &recordWriter{Out: out, recorder: rec}
+		if errOut != nil {
+			errOut = &recordWriter{Out: errOut, recorder: rec}
+		}
+		if sizeQueue != nil {
+			sizeQueue = &recordSizeQueue{TerminalSizeQueue: sizeQueue, recorder: rec}
+		}
+	}
+
 	execCommand := []string{
 		"/bin/bash",
 		"-c",
@@ -116,12 +213,12 @@ func debug(name string) {
 		`,
 	}
 
-	if len(command) > 0 {
-		execCommand = command
+	if len(o.Command) > 0 {
+		execCommand = o.Command
 	}
 
 	fn := func() error {
-		req := session.clientset.CoreV1().RESTClient().
+		req := clientset.CoreV1().RESTClient().
 			Post().
 			Namespace(pod.Namespace).
 			Resource("pods").
@@ -138,15 +235,15 @@ func debug(name string) {
 
 		return func() error {
 
-			exec, err := remotecommand.NewSPDYExecutor(session.config, "POST", req.URL())
+			exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
 			if err != nil {
-				panic(err)
+				return err
 			}
 
-			return exec.Stream(remotecommand.StreamOptions{
-				Stdin:             streamOptions.In,
-				Stdout:            streamOptions.Out,
-				Stderr:            streamOptions.ErrOut,
+			return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+				Stdin:             in,
+				Stdout:            out,
+				Stderr:            errOut,
 				Tty:               t.Raw,
 				TerminalSizeQueue: sizeQueue,
 			})
@@ -154,10 +251,23 @@ func debug(name string) {
 
 	}
 
-	if err := t.Safe(fn); err != nil {
-		panic(err)
-	}
+	return t.Safe(fn)
+}
+
+// Prefix of the labels on the pods of a Tf. Pods created by terraform-operator
+// use legacyLabelPrefix.
+const (
+	labelPrefix       = "infra3.galleybytes.com/"
+	legacyLabelPrefix = "terraforms.tf.isaaguilar.com/"
+)
 
+// podLabel returns the value of the label name of a Tf pod created by either
+// infrakube or terraform-operator.
+func podLabel(pod corev1.Pod, name string) string {
+	if value, ok := pod.Labels[labelPrefix+name]; ok {
+		return value
+	}
+	return pod.Labels[legacyLabelPrefix+name]
 }
 
 func generatePod(tf *tfv1beta1.Tf) *corev1.Pod {
@@ -290,10 +400,10 @@ func generatePod(tf *tfv1beta1.Tf) *corev1.Pod {
 		}
 	}
 
-	labels["terraforms.tf.isaaguilar.com/generation"] = generation
-	labels["terraforms.tf.isaaguilar.com/resourceName"] = tf.Name
-	labels["terraforms.tf.isaaguilar.com/podPrefix"] = tf.Status.PodNamePrefix
-	labels["terraforms.tf.isaaguilar.com/tfVersion"] = tf.Spec.TfVersion
+	labels[labelPrefix+"generation"] = generation
+	labels[labelPrefix+"resourceName"] = tf.Name
+	labels[labelPrefix+"podPrefix"] = tf.Status.PodNamePrefix
+	labels[labelPrefix+"tfVersion"] = tf.Spec.TfVersion
 	labels["app.kubernetes.io/name"] = "infrakube"
 	labels["app.kubernetes.io/component"] = "infrakube-cli"
 	labels["app.kubernetes.io/instance"] = "debug"
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	tfv1beta1 "github.com/galleybytes/infrakube/pkg/apis/infra3/v1"
+	infrakube "github.com/galleybytes/infrakube/pkg/client/clientset/versioned"
+	infrakubefake "github.com/galleybytes/infrakube/pkg/client/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeFactory is a Factory of fake clientsets
+type fakeFactory struct {
+	clientset          *k8sfake.Clientset
+	infrakubeclientset *infrakubefake.Clientset
+}
+
+func (f *fakeFactory) Namespace() (string, error) {
+	return "default", nil
+}
+
+func (f *fakeFactory) RESTConfig() (*rest.Config, error) {
+	return &rest.Config{Host: "https://127.0.0.1:6443"}, nil
+}
+
+func (f *fakeFactory) KubernetesClientSet() (kubernetes.Interface, error) {
+	return f.clientset, nil
+}
+
+func (f *fakeFactory) InfrakubeClientSet() (infrakube.Interface, error) {
+	return f.infrakubeclientset, nil
+}
+
+// newFakeFactory returns a Factory of fake clientsets with the Tfs tfs. The
+// pods it creates get a name from their generateName and are ready once they
+// are watched.
+func newFakeFactory(tfs ...runtime.Object) *fakeFactory {
+	clientset := k8sfake.NewSimpleClientset()
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		if pod.Name == "" {
+			pod.Name = pod.GenerateName + "abcde"
+		}
+		return false, nil, nil
+	})
+	clientset.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		pods, err := clientset.Tracker().List(corev1.SchemeGroupVersion.WithResource("pods"), corev1.SchemeGroupVersion.WithKind("Pod"), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		watcher := watch.NewFakeWithChanSize(2, false)
+		for _, pod := range pods.(*corev1.PodList).Items {
+			pending := pod.DeepCopy()
+			pending.Status.Phase = corev1.PodPending
+			watcher.Modify(pending)
+
+			ready := pod.DeepCopy()
+			ready.Status.Phase = corev1.PodRunning
+			ready.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+			watcher.Modify(ready)
+		}
+		return true, watcher, nil
+	})
+	return &fakeFactory{
+		clientset:          clientset,
+		infrakubeclientset: infrakubefake.NewSimpleClientset(tfs...),
+	}
+}
+
+func newTestTf() *tfv1beta1.Tf {
+	return &tfv1beta1.Tf{
+		ObjectMeta: metav1.ObjectMeta{Name: "vpc", Namespace: "default", Generation: 3},
+		Spec:       tfv1beta1.TfSpec{TfVersion: "1.5.7"},
+		Status:     tfv1beta1.TfStatus{PodNamePrefix: "vpc-x1y2"},
+	}
+}
+
+func TestDebugStartPod(t *testing.T) {
+	f := newFakeFactory(newTestTf())
+	var out bytes.Buffer
+	o := &DebugOptions{
+		Factory:   f,
+		Namespace: "default",
+		Name:      "vpc",
+		IOStreams: genericclioptions.IOStreams{In: strings.NewReader(""), Out: &out, ErrOut: &out},
+	}
+	ctx := context.Background()
+
+	pod, err := o.startPod(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Name != "vpc-x1y2-v3-debug-abcde" {
+		t.Errorf("got pod %s, want vpc-x1y2-v3-debug-abcde", pod.Name)
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		t.Errorf("got phase %s, want the pod once it is running", pod.Status.Phase)
+	}
+	if !strings.Contains(out.String(), "Connecting to vpc-x1y2-v3-debug-abcde") {
+		t.Errorf("got output %q", out.String())
+	}
+
+	created, err := f.clientset.CoreV1().Pods("default").Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := created.Spec.Containers[0].Image; got != "ghcr.io/galleybytes/infra3-tftask-v1:1.5.7" {
+		t.Errorf("got image %s", got)
+	}
+	if got := created.Spec.ServiceAccountName; got != "tf-vpc-x1y2-v3" {
+		t.Errorf("got service account %s, want tf-vpc-x1y2-v3", got)
+	}
+	if got := podLabel(*created, "resourceName"); got != "vpc" {
+		t.Errorf("got resourceName label %q, want vpc", got)
+	}
+
+	o.deletePod(pod)
+	_, err = f.clientset.CoreV1().Pods("default").Get(ctx, pod.Name, metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("got %v, want the pod deleted", err)
+	}
+}
+
+func TestDebugStartPodNotFound(t *testing.T) {
+	f := newFakeFactory(newTestTf())
+	var out bytes.Buffer
+	o := &DebugOptions{
+		Factory:   f,
+		Namespace: "other",
+		Name:      "vpc",
+		IOStreams: genericclioptions.IOStreams{In: strings.NewReader(""), Out: &out, ErrOut: &out},
+	}
+
+	pod, err := o.startPod(context.Background())
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("got %v, want not found", err)
+	}
+	if ExitCode(err) != ExitNotFound {
+		t.Errorf("got exit code %d, want %d", ExitCode(err), ExitNotFound)
+	}
+	if pod != nil {
+		t.Errorf("got pod %s, want none", pod.Name)
+	}
+	pods, err := f.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("got %d pods, want none", len(pods.Items))
+	}
+}
+
+func TestPodLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"infrakube", map[string]string{labelPrefix + "generation": "3"}, "3"},
+		{"terraform-operator", map[string]string{legacyLabelPrefix + "generation": "2"}, "2"},
+		{"both", map[string]string{labelPrefix + "generation": "3", legacyLabelPrefix + "generation": "2"}, "3"},
+		{"none", map[string]string{"generation": "1"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: tt.labels}}
+			if got := podLabel(pod, "generation"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
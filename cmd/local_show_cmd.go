@@ -3,7 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"log"
+	"io"
 	"os"
 
 	tfv1beta1 "github.com/galleybytes/infrakube/pkg/apis/infra3/v1"
@@ -17,13 +17,26 @@ var showCmd = &cobra.Command{
 	Use:   "show",
 	Short: "Show a comprehensive list of infrakube related resources",
 	Args:  cobra.MaximumNArgs(0),
-	Run: func(cmd *cobra.Command, args []string) {
-		show("name", allNamespaces, false)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		showOpts.Factory = factory
+		showOpts.Namespace = resolveNamespace(factory)
+		showOpts.Out = os.Stdout
+		return show(cmd.Context(), showOpts)
 	},
 }
 
+type showOptions struct {
+	Factory       Factory
+	Namespace     string
+	AllNamespaces bool
+	ShowPrevious  bool
+	Out           io.Writer
+}
+
+var showOpts = &showOptions{}
+
 func init() {
-	showCmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "Show infrakube resources for all namespaces")
+	showCmd.Flags().BoolVarP(&showOpts.AllNamespaces, "all-namespaces", "A", false, "Show infrakube resources for all namespaces")
 	//
 	// TODO the show command is broken and needs works. Perhaps "show" should be "list"
 	// Other ideas might be that "list tf" to lists the terraform resources (ie kubectl get tf)
@@ -32,7 +45,17 @@ func init() {
 	// localCmd.AddCommand(showCmd)
 }
 
-func show(name string, allNamespaces, showPrevious bool) {
+func show(ctx context.Context, o *showOptions) error {
+	allNamespaces, showPrevious := o.AllNamespaces, o.ShowPrevious
+	clientset, err := o.Factory.KubernetesClientSet()
+	if err != nil {
+		return err
+	}
+	infrakubeclientset, err := o.Factory.InfrakubeClientSet()
+	if err != nil {
+		return err
+	}
+
 	var data [][]string
 	var header []string
 	var namespaces []string
@@ -41,43 +64,43 @@ func show(name string, allNamespaces, showPrevious bool) {
 
 	if allNamespaces {
 		header = []string{"Namespace", "Name", "Generation", "Pods"}
-		namespaceClient := session.clientset.CoreV1().Namespaces()
-		namespaceList, err := namespaceClient.List(context.TODO(), metav1.ListOptions{})
+		namespaceClient := clientset.CoreV1().Namespaces()
+		namespaceList, err := namespaceClient.List(ctx, metav1.ListOptions{})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		for _, namespace := range namespaceList.Items {
 			namespaces = append(namespaces, namespace.Name)
 		}
 
-		tfClient := session.infrakubeclientset.Infra3V1().Tfs("")
-		tfList, err := tfClient.List(context.TODO(), metav1.ListOptions{})
+		tfClient := infrakubeclientset.Infra3V1().Tfs("")
+		tfList, err := tfClient.List(ctx, metav1.ListOptions{})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		tfs = tfList.Items
 
-		podClient := session.clientset.CoreV1().Pods("")
-		podList, err := podClient.List(context.TODO(), metav1.ListOptions{})
+		podClient := clientset.CoreV1().Pods("")
+		podList, err := podClient.List(ctx, metav1.ListOptions{})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		pods = podList.Items
 	} else {
 		header = []string{"Name", "Generation", "Pods"}
-		namespaces = []string{session.namespace}
+		namespaces = []string{o.Namespace}
 
-		tfClient := session.infrakubeclientset.Infra3V1().Tfs(session.namespace)
-		tfList, err := tfClient.List(context.TODO(), metav1.ListOptions{})
+		tfClient := infrakubeclientset.Infra3V1().Tfs(o.Namespace)
+		tfList, err := tfClient.List(ctx, metav1.ListOptions{})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		tfs = tfList.Items
 
-		podClient := session.clientset.CoreV1().Pods(session.namespace)
-		podList, err := podClient.List(context.TODO(), metav1.ListOptions{})
+		podClient := clientset.CoreV1().Pods(o.Namespace)
+		podList, err := podClient.List(ctx, metav1.ListOptions{})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		pods = podList.Items
 	}
@@ -116,7 +139,7 @@ func show(name string, allNamespaces, showPrevious bool) {
 			var currentRunnerEntryIndex int
 			var previousRunnersEntryIndex int
 			for _, pod := range namespacedPods {
-				if pod.Labels["terraforms.tf.isaaguilar.com/generation"] == generation {
+				if podLabel(pod, "generation") == generation {
 					if len(data) == data_index+currentRunnerEntryIndex {
 						if allNamespaces {
 							data = append(data, []string{"", "", "", pod.Name, ""})
@@ -149,7 +172,7 @@ func show(name string, allNamespaces, showPrevious bool) {
 	if showPrevious {
 		header = append(header, "PreviousPods")
 	}
-	table := tablewriter.NewWriter(os.Stdout)
+	table := tablewriter.NewWriter(o.Out)
 	table.SetAutoWrapText(false)
 	table.SetAutoFormatHeaders(true)
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
@@ -164,5 +187,5 @@ func show(name string, allNamespaces, showPrevious bool) {
 	table.SetHeader(header)
 	table.AppendBulk(data)
 	table.Render()
-
+	return nil
 }
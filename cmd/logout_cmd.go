@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
+	"github.com/spf13/cobra"
+)
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "Remove the token for the API host",
+	Long: `Revokes the token with the API, when the API supports it, and removes the token
+and refresh token for the host from the credential store.`,
+	Args: cobra.MaximumNArgs(0),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if logoutOpts.Host == "" {
+			logoutOpts.Host = configString("host")
+		}
+		if logoutOpts.Host == "" {
+			return usageError(fmt.Errorf("`--host` is required"))
+		}
+		return completeTransportOptions(cmd.Flags(), &logoutOpts.Transport)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return logout(cmd.Context(), logoutOpts)
+	},
+}
+
+var logoutOpts = &ConnectOptions{}
+
+func init() {
+	logoutCmd.Flags().StringVarP(&logoutOpts.Host, "host", "H", "", "Infrakube API URL")
+	addTransportFlags(logoutCmd.Flags(), &logoutOpts.Transport)
+	rootCmd.AddCommand(logoutCmd)
+}
+
+func logout(ctx context.Context, o *ConnectOptions) error {
+	store, err := newCredentialStore(ctx)
+	if err != nil {
+		return err
+	}
+	token, err := store.Get(o.Host)
+	if err != nil {
+		return err
+	}
+	// Tokens used to be saved in plaintext in the config, next to the host
+	// they are for. Only the file is read, a token from IK_TOKEN is not ik's
+	// to log out of.
+	cfg, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	var configToken string
+	if credentialKey(configFileString(cfg, "host")) == credentialKey(o.Host) {
+		configToken = configFileString(cfg, "token")
+	}
+	if token == "" {
+		token = configToken
+	}
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "Not logged in to %s\n", o.Host)
+		return nil
+	}
+
+	// The token is removed locally even when it can't be revoked, eg because
+	// it already expired. Tokens that are also set in IK_TOKEN are shared,
+	// eg by CI jobs, and are never revoked.
+	if token == getEnv("token") {
+		fmt.Fprintln(os.Stderr, "warning: the token is also set in IK_TOKEN, it was not revoked")
+	} else if err := revokeToken(ctx, o, token); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to revoke the token: %s\n", err)
+	}
+
+	if err := store.Delete(o.Host); err != nil {
+		return err
+	}
+	if err := store.Delete(refreshCredentialKey(o.Host)); err != nil {
+		return err
+	}
+	if configToken != "" {
+		if err := updateConfig(func(cfg map[string]interface{}) error {
+			unsetConfigKey(cfg, "token")
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Logged out of %s\n", o.Host)
+	if getEnv("token") != "" {
+		fmt.Fprintln(os.Stderr, "note: IK_TOKEN is still set and will be used")
+	}
+	return nil
+}
+
+// revokeToken invalidates token on the server. APIs without a revoke endpoint
+// are skipped.
+func revokeToken(ctx context.Context, o *ConnectOptions, token string) error {
+	client, err := newStellaClient(o.Host, &o.Transport)
+	if err != nil {
+		return err
+	}
+	client.Token = token
+	if err := client.Revoke(ctx); err != nil && !errors.Is(err, stella.ErrNotSupported) {
+		return stellaError(err)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var migrateConfigCmd = &cobra.Command{
+	Use:   "migrate-config",
+	Short: "Rewrite a config written by terraform-operator or older versions of ik",
+	Long: `Rewrites old config keys and layouts to the current format:
+
+  - top-level settings like 'host' and 'username' are moved to a profile
+  - tokens are moved to the credential store
+  - plaintext passwords and the stale 'config' key are removed
+
+The config is backed up to <config>.bak first. Use '--from' to import a config
+from elsewhere, eg the terraform-operator config, into the ik config. Imported
+profiles never replace existing ones.`,
+	Args: cobra.MaximumNArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migrateConfigFile(cmd.Context(), migrateConfigOpts)
+	},
+}
+
+type migrateConfigOptions struct {
+	From        string
+	ProfileName string
+	DryRun      bool
+}
+
+var migrateConfigOpts = &migrateConfigOptions{}
+
+func init() {
+	migrateConfigCmd.Flags().StringVar(&migrateConfigOpts.From, "from", "", "Config file to import (default is the ik config)")
+	migrateConfigCmd.Flags().StringVar(&migrateConfigOpts.ProfileName, "profile-name", "default", "Profile to move top-level settings to when no profile is current")
+	migrateConfigCmd.Flags().BoolVar(&migrateConfigOpts.DryRun, "dry-run", false, "Print the migrated config without writing anything")
+	rootCmd.AddCommand(migrateConfigCmd)
+}
+
+func migrateConfigFile(ctx context.Context, o *migrateConfigOptions) error {
+	cfg, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	original, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	source := cfg
+	if o.From != "" {
+		b, err := os.ReadFile(o.From)
+		if err != nil {
+			return err
+		}
+		source = map[string]interface{}{}
+		if err := yaml.Unmarshal(b, &source); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", o.From, err)
+		}
+		if source == nil {
+			source = map[string]interface{}{}
+		}
+	}
+
+	changes, tokens := migrateConfig(source, normalizeProfileName(o.ProfileName))
+	if o.From != "" {
+		changes = append(changes, importConfig(cfg, source)...)
+	}
+
+	if len(changes) == 0 && len(tokens) == 0 {
+		fmt.Printf("%s is up to date\n", viper.ConfigFileUsed())
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if o.DryRun {
+		redactConfig(cfg)
+		b, err := yaml.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n%s", string(b))
+		return nil
+	}
+
+	// Tokens are saved first so a failure doesn't lose them from the config
+	if len(tokens) > 0 {
+		store, err := newCredentialStore(ctx)
+		if err != nil {
+			return err
+		}
+		for host, token := range tokens {
+			if err := store.Set(host, token); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := viper.ConfigFileUsed()
+	if err := writePrivateFile(name+".bak", original); err != nil {
+		return err
+	}
+	if err := writePrivateFile(name, b); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %s, the previous config was saved to %s.bak\n", name, name)
+	return viper.MergeInConfig()
+}
+
+// migrateConfig rewrites cfg to the current layout and returns a description
+// of each change. Tokens are removed from cfg and returned keyed by their host
+// so they can be moved to the credential store.
+func migrateConfig(cfg map[string]interface{}, profile string) ([]string, map[string]string) {
+	var changes []string
+	tokens := map[string]string{}
+
+	if _, ok := cfg["config"]; ok {
+		delete(cfg, "config")
+		changes = append(changes, "removed config: it is ignored, use `--config` instead")
+	}
+
+	// Settings at the top-level come from configs written before profiles.
+	// They are moved to the current profile, without replacing its values.
+	var keys []string
+	for key := range cfg {
+		if profileConfigKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		if current, ok := cfg["current-profile"].(string); ok && current != "" {
+			profile = current
+		}
+		profiles, _ := cfg["profiles"].(map[string]interface{})
+		if profiles == nil {
+			profiles = map[string]interface{}{}
+			cfg["profiles"] = profiles
+		}
+		settings, _ := profiles[profile].(map[string]interface{})
+		if settings == nil {
+			settings = map[string]interface{}{}
+			profiles[profile] = settings
+		}
+		for _, key := range keys {
+			if _, ok := settings[key]; ok {
+				changes = append(changes, fmt.Sprintf("removed %s: profiles.%s.%s is already set", key, profile, key))
+			} else {
+				settings[key] = cfg[key]
+				changes = append(changes, fmt.Sprintf("moved %s to profiles.%s.%s", key, profile, key))
+			}
+			delete(cfg, key)
+		}
+		if _, ok := cfg["current-profile"]; !ok {
+			cfg["current-profile"] = profile
+			changes = append(changes, fmt.Sprintf("set current-profile to %s", profile))
+		}
+	}
+
+	profiles, _ := cfg["profiles"].(map[string]interface{})
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		settings, ok := profiles[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		prefix := "profiles." + name + "."
+		if _, ok := settings["password"]; ok {
+			delete(settings, "password")
+			changes = append(changes, fmt.Sprintf("removed %spassword: run `ik connect` or set IK_PASSWORD instead", prefix))
+		}
+		token, ok := settings["token"].(string)
+		if !ok {
+			continue
+		}
+		host, _ := settings["host"].(string)
+		if host == "" {
+			changes = append(changes, fmt.Sprintf("kept %stoken: the profile has no host to store it under", prefix))
+			continue
+		}
+		delete(settings, "token")
+		if token != "" {
+			tokens[credentialKey(host)] = token
+		}
+		changes = append(changes, fmt.Sprintf("moved %stoken to the credential store for %s", prefix, host))
+	}
+	return changes, tokens
+}
+
+// importConfig adds the profiles of source to cfg. Profiles already in cfg are
+// kept as they are.
+func importConfig(cfg, source map[string]interface{}) []string {
+	var changes []string
+	sourceProfiles, _ := source["profiles"].(map[string]interface{})
+	profiles, _ := cfg["profiles"].(map[string]interface{})
+	if profiles == nil {
+		profiles = map[string]interface{}{}
+	}
+	var names []string
+	for name := range sourceProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := profiles[name]; ok {
+			changes = append(changes, fmt.Sprintf("skipped profiles.%s: it already exists", name))
+			continue
+		}
+		profiles[name] = sourceProfiles[name]
+		changes = append(changes, fmt.Sprintf("imported profiles.%s", name))
+	}
+	if len(profiles) > 0 {
+		cfg["profiles"] = profiles
+	}
+	if current, ok := source["current-profile"].(string); ok && current != "" {
+		if value, _ := cfg["current-profile"].(string); value == "" {
+			cfg["current-profile"] = current
+			changes = append(changes, fmt.Sprintf("set current-profile to %s", current))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		want        string
+		wantTokens  map[string]string
+		wantChanges int
+	}{
+		{
+			name: "top-level settings",
+			config: `
+config: /home/me/.tfo/config
+host: https://API.example.com/
+username: admin
+token: legacy
+password: hunter2
+`,
+			want: `
+current-profile: default
+profiles:
+  default:
+    host: https://API.example.com/
+    username: admin
+`,
+			wantTokens:  map[string]string{"https://api.example.com": "legacy"},
+			wantChanges: 8,
+		},
+		{
+			name: "current profile is kept",
+			config: `
+current-profile: prod
+host: https://old.example.com
+namespace: default
+profiles:
+  prod:
+    host: https://prod.example.com
+`,
+			want: `
+current-profile: prod
+profiles:
+  prod:
+    host: https://prod.example.com
+    namespace: default
+`,
+			wantTokens:  map[string]string{},
+			wantChanges: 2,
+		},
+		{
+			name: "profile without a host keeps its token",
+			config: `
+profiles:
+  dev:
+    token: legacy
+`,
+			want: `
+profiles:
+  dev:
+    token: legacy
+`,
+			wantTokens:  map[string]string{},
+			wantChanges: 1,
+		},
+		{
+			name: "up to date",
+			config: `
+current-profile: prod
+profiles:
+  prod:
+    host: https://prod.example.com
+`,
+			want: `
+current-profile: prod
+profiles:
+  prod:
+    host: https://prod.example.com
+`,
+			wantTokens: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg, want map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tt.config), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			changes, tokens := migrateConfig(cfg, "default")
+			if !reflect.DeepEqual(cfg, want) {
+				got, _ := yaml.Marshal(cfg)
+				t.Errorf("got config:\n%s\nwant:%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(tokens, tt.wantTokens) {
+				t.Errorf("got tokens %v, want %v", tokens, tt.wantTokens)
+			}
+			if len(changes) != tt.wantChanges {
+				t.Errorf("got %d changes %q, want %d", len(changes), changes, tt.wantChanges)
+			}
+		})
+	}
+}
+
+func TestImportConfig(t *testing.T) {
+	cfg := map[string]interface{}{
+		"profiles": map[string]interface{}{
+			"prod": map[string]interface{}{"host": "https://prod.example.com"},
+		},
+	}
+	source := map[string]interface{}{
+		"current-profile": "dev",
+		"profiles": map[string]interface{}{
+			"prod": map[string]interface{}{"host": "https://other.example.com"},
+			"dev":  map[string]interface{}{"host": "https://dev.example.com"},
+		},
+	}
+	changes := importConfig(cfg, source)
+	want := map[string]interface{}{
+		"current-profile": "dev",
+		"profiles": map[string]interface{}{
+			"prod": map[string]interface{}{"host": "https://prod.example.com"},
+			"dev":  map[string]interface{}{"host": "https://dev.example.com"},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %v, want %v", cfg, want)
+	}
+	if len(changes) != 3 {
+		t.Errorf("got changes %q, want 3", changes)
+	}
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var pluginCmd = &cobra.Command{
+	Use:   "plugin",
+	Short: "Manage ik as a kubectl plugin",
+	Args:  cobra.MaximumNArgs(0),
+}
+
+var pluginInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install ik as a kubectl plugin",
+	Long: `Creates a kubectl-<name> symlink to this binary so ik can be run as
+'kubectl ik' or 'kubectl tf'. As a plugin, the local commands are available at
+the top-level, eg 'kubectl tf debug <tf-resource-name>'.`,
+	Args: cobra.MaximumNArgs(0),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pluginInstall(pluginInstallOpts)
+	},
+}
+
+type pluginInstallOptions struct {
+	Dir   string
+	Names []string
+	Force bool
+}
+
+var pluginInstallOpts = &pluginInstallOptions{}
+
+// Names ik can be installed as, ie kubectl-ik and kubectl-tf
+var pluginNames = []string{"ik", "tf", "tfo"}
+
+func init() {
+	pluginInstallCmd.Flags().StringVar(&pluginInstallOpts.Dir, "dir", "", "Directory on PATH to create the symlink in (default is the directory of this binary)")
+	pluginInstallCmd.Flags().StringSliceVar(&pluginInstallOpts.Names, "name", []string{"ik"}, "Plugin name, one of "+strings.Join(pluginNames, ", ")+". Can be repeated")
+	pluginInstallCmd.Flags().BoolVar(&pluginInstallOpts.Force, "force", false, "Replace an existing file with the same name")
+
+	pluginCmd.AddCommand(pluginInstallCmd)
+	rootCmd.AddCommand(pluginCmd)
+}
+
+// kubectlPluginName returns the plugin name when ik was invoked by kubectl,
+// ie "tf" when the binary is named kubectl-tf.
+func kubectlPluginName() string {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if !strings.HasPrefix(name, "kubectl-") {
+		return ""
+	}
+	return strings.TrimPrefix(name, "kubectl-")
+}
+
+// setupCommands adds the kubectl flags to the local commands. When ik runs as
+// a kubectl plugin, the kubectl flags are global and the local commands are
+// also available at the top-level.
+func setupCommands() {
+	name := kubectlPluginName()
+	if name == "" {
+		kubeConfigFlags.AddFlags(localCmd.PersistentFlags())
+		return
+	}
+
+	if rootCmd.Annotations == nil {
+		rootCmd.Annotations = map[string]string{}
+	}
+	rootCmd.Annotations[cobra.CommandDisplayNameAnnotation] = "kubectl " + name
+	rootCmd.Aliases = nil
+	rootCmd.Short = "Manage Infrakube resources with kubectl"
+	kubeConfigFlags.AddFlags(rootCmd.PersistentFlags())
+
+	for _, c := range localCmd.Commands() {
+		promoted := &cobra.Command{
+			Use:               c.Use,
+			Aliases:           c.Aliases,
+			Short:             c.Short,
+			Long:              c.Long,
+			Args:              c.Args,
+			ValidArgsFunction: c.ValidArgsFunction,
+			PreRunE:           c.PreRunE,
+			RunE:              c.RunE,
+		}
+		promoted.Flags().AddFlagSet(c.Flags())
+		rootCmd.AddCommand(promoted)
+	}
+}
+
+func pluginInstall(o *pluginInstallOptions) error {
+	for _, name := range o.Names {
+		if !slices.Contains(pluginNames, name) {
+			return usageError(fmt.Errorf("invalid plugin name %q, expected one of %s", name, strings.Join(pluginNames, ", ")))
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+
+	dir := o.Dir
+	if dir == "" {
+		dir = filepath.Dir(executable)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range o.Names {
+		link := filepath.Join(dir, "kubectl-"+name)
+		if target, err := os.Readlink(link); err == nil && target == executable {
+			fmt.Printf("%s is already installed\n", link)
+			continue
+		}
+		if _, err := os.Lstat(link); err == nil {
+			if !o.Force {
+				return usageError(fmt.Errorf("%s already exists. Use `--force` to replace it", link))
+			}
+			if err := os.Remove(link); err != nil {
+				return err
+			}
+		}
+		if err := os.Symlink(executable, link); err != nil {
+			return err
+		}
+		fmt.Printf("Installed %s, run it with 'kubectl %s'\n", link, name)
+	}
+
+	if !slices.Contains(filepath.SplitList(os.Getenv("PATH")), dir) {
+		fmt.Fprintf(os.Stderr, "warning: %s is not in PATH, kubectl will not find the plugin\n", dir)
+	}
+	return nil
+}
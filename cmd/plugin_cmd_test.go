@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// The kubectl flags are global in plugin mode, a command with a clashing flag
+// panics once cobra merges them, eg when printing its help.
+func TestPluginModeHelp(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"kubectl-ik"}
+	setupCommands()
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&out)
+	defer func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		rootCmd.SetArgs(nil)
+	}()
+
+	// cobra adds the completion command on the first run
+	rootCmd.SetArgs([]string{"--help"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("--help: %s", err)
+	}
+
+	var paths [][]string
+	var walk func(c *cobra.Command, path []string)
+	walk = func(c *cobra.Command, path []string) {
+		for _, sub := range c.Commands() {
+			if sub.Hidden {
+				continue
+			}
+			subPath := append(append([]string{}, path...), sub.Name())
+			paths = append(paths, subPath)
+			walk(sub, subPath)
+		}
+	}
+	walk(rootCmd, nil)
+
+	for _, path := range paths {
+		t.Run(strings.Join(path, " "), func(t *testing.T) {
+			out.Reset()
+			rootCmd.SetArgs(append(path, "--help"))
+			if err := rootCmd.Execute(); err != nil {
+				t.Fatalf("--help: %s", err)
+			}
+			if !strings.Contains(out.String(), "Usage:") {
+				t.Errorf("--help printed no usage:\n%s", out.String())
+			}
+		})
+	}
+}
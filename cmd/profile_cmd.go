@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage named profiles in the config",
+	Long: `Profiles group the settings used to talk to a single API host and cluster:
+host, token, username, default client, kube context and default namespace.
+The active profile is selected with '--profile' or 'ik profile use'.`,
+	Args: cobra.MaximumNArgs(0),
+}
+
+var profileListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List the profiles in the config",
+	Args:    cobra.MaximumNArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		profileList()
+	},
+}
+
+var profileUseCmd = &cobra.Command{
+	Use:               "use <profile-name>",
+	Short:             "Set the current profile",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeProfiles,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := profileUse(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Switched to profile %q\n", normalizeProfileName(args[0]))
+		return nil
+	},
+}
+
+var profileAddCmd = &cobra.Command{
+	Use:   "add <profile-name>",
+	Short: "Add a profile or update the settings of an existing one",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return profileAdd(cmd, args[0], profileAddOpts)
+	},
+}
+
+var profileDeleteCmd = &cobra.Command{
+	Use:               "delete <profile-name>",
+	Aliases:           []string{"rm"},
+	Short:             "Delete a profile",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeProfiles,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return profileDelete(args[0])
+	},
+}
+
+type profileAddOptions struct {
+	Host        string
+	ClientName  string
+	KubeContext string
+	Token       string
+	Use         bool
+}
+
+var profileAddOpts = &profileAddOptions{}
+
+func init() {
+	profileAddCmd.Flags().StringVarP(&profileAddOpts.Host, "host", "H", "", "Infrakube API URL")
+	profileAddCmd.Flags().StringVarP(&profileAddOpts.ClientName, "client", "c", "", "The default client identifier")
+	profileAddCmd.Flags().StringVar(&profileAddOpts.KubeContext, "kube-context", "", "The kubeconfig context used by local commands")
+	profileAddCmd.Flags().StringVar(&profileAddOpts.Token, "token", "", "Token for the API, saved in the credential store (normally set by `ik connect`)")
+	profileAddCmd.Flags().BoolVar(&profileAddOpts.Use, "use", false, "Make this the current profile")
+
+	profileCmd.AddCommand(profileListCmd)
+	profileCmd.AddCommand(profileUseCmd)
+	profileCmd.AddCommand(profileAddCmd)
+	profileCmd.AddCommand(profileDeleteCmd)
+	rootCmd.AddCommand(profileCmd)
+}
+
+// normalizeProfileName lowercases the name since viper keys are case
+// insensitive.
+func normalizeProfileName(name string) string {
+	return strings.ToLower(name)
+}
+
+// activeProfile returns the profile selected by `--profile` or the config's
+// current-profile. An empty string means the top-level keys are used.
+func activeProfile() string {
+	if profileName != "" {
+		return normalizeProfileName(profileName)
+	}
+	return viper.GetString("current-profile")
+}
+
+// managesProfiles returns true for `ik profile` and `ik migrate-config`,
+// which run without the active profile.
+func managesProfiles(cmd *cobra.Command) bool {
+	if cmd == nil {
+		return false
+	}
+	if cmd == migrateConfigCmd || cmd == profileCmd {
+		return true
+	}
+	return cmd.HasParent() && cmd.Parent() == profileCmd
+}
+
+func profileExists(name string) bool {
+	_, ok := viper.GetStringMap("profiles")[normalizeProfileName(name)]
+	return ok
+}
+
+// configString looks up key from, in order, the IK_* environment, the active
+// profile and the top-level of the config. Flags are expected to be checked by
+// the caller.
+func configString(key string) string {
+	if value, ok := lookupEnv(key); ok {
+		return value
+	}
+	if name := activeProfile(); name != "" {
+		if value := viper.GetString("profiles." + name + "." + key); value != "" {
+			return value
+		}
+	}
+	return viper.GetString(key)
+}
+
+// configStringMap looks up a map from the active profile, or the top-level of
+// the config when the profile doesn't set it. Keys are lowercase.
+func configStringMap(key string) map[string]string {
+	if name := activeProfile(); name != "" {
+		if value := viper.GetStringMapString("profiles." + name + "." + key); len(value) > 0 {
+			return value
+		}
+	}
+	return viper.GetStringMapString(key)
+}
+
+// configFileString looks up key in the active profile and the top-level of
+// cfg, the parsed config file. Unlike configString, the environment is
+// ignored.
+func configFileString(cfg map[string]interface{}, key string) string {
+	if name := activeProfile(); name != "" {
+		profiles, _ := cfg["profiles"].(map[string]interface{})
+		profile, _ := profiles[name].(map[string]interface{})
+		if value, _ := profile[key].(string); value != "" {
+			return value
+		}
+	}
+	value, _ := cfg[key].(string)
+	return value
+}
+
+// setProfileValue sets key in the active profile, or at the top-level of
+// the config when no profile is active.
+func setProfileValue(cfg map[string]interface{}, key string, value interface{}) {
+	if name := activeProfile(); name != "" {
+		setConfigValue(cfg, "profiles."+name+"."+key, value)
+		return
+	}
+	setConfigValue(cfg, key, value)
+}
+
+func profileList() {
+	profiles := viper.GetStringMap("profiles")
+	if len(profiles) == 0 {
+		fmt.Fprintln(os.Stderr, "No profiles found. Add one with `ik profile add`")
+		return
+	}
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	current := activeProfile()
+	var data [][]string
+	for _, name := range names {
+		marker := ""
+		if name == current {
+			marker = "*"
+		}
+		key := "profiles." + name + "."
+		data = append(data, []string{
+			marker,
+			name,
+			viper.GetString(key + "host"),
+			viper.GetString(key + "client"),
+			viper.GetString(key + "context"),
+			viper.GetString(key + "namespace"),
+		})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetTablePadding("\t") // pad with tabs
+	table.SetNoWhiteSpace(true)
+	table.SetHeader([]string{"Current", "Name", "Host", "Client", "Context", "Namespace"})
+	table.AppendBulk(data)
+	table.Render()
+}
+
+func profileUse(name string) error {
+	name = normalizeProfileName(name)
+	if !profileExists(name) {
+		return notFoundError(fmt.Errorf("profile %q not found", name))
+	}
+	return updateConfig(func(cfg map[string]interface{}) error {
+		cfg["current-profile"] = name
+		return nil
+	})
+}
+
+func profileAdd(cmd *cobra.Command, name string, o *profileAddOptions) error {
+	name = normalizeProfileName(name)
+	if name == "" || strings.ContainsAny(name, ". ") {
+		return usageError(fmt.Errorf("invalid profile name %q", name))
+	}
+	values := map[string]string{}
+	if cmd.Flags().Changed("host") {
+		values["host"] = o.Host
+	}
+	if cmd.Flags().Changed("client") {
+		values["client"] = o.ClientName
+	}
+	if cmd.Flags().Changed("kube-context") {
+		values["context"] = o.KubeContext
+	}
+	if cmd.Flags().Changed("namespace") {
+		values["namespace"] = namespace
+	}
+	if cmd.Flags().Changed("token") {
+		// Tokens are kept in the credential store under the profile's host
+		tokenHost := o.Host
+		if tokenHost == "" {
+			tokenHost = viper.GetString("profiles." + name + ".host")
+		}
+		if tokenHost == "" {
+			return usageError(fmt.Errorf("`--token` requires the profile to have a host"))
+		}
+		store, err := newCredentialStore(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if err := store.Set(tokenHost, o.Token); err != nil {
+			return err
+		}
+	}
+
+	return updateConfig(func(cfg map[string]interface{}) error {
+		// Make sure the profile exists even when no values are passed in
+		profiles, ok := cfg["profiles"].(map[string]interface{})
+		if !ok {
+			profiles = map[string]interface{}{}
+			cfg["profiles"] = profiles
+		}
+		if _, ok := profiles[name].(map[string]interface{}); !ok {
+			profiles[name] = map[string]interface{}{}
+		}
+		for key, value := range values {
+			setConfigValue(cfg, "profiles."+name+"."+key, value)
+		}
+		if o.Use {
+			cfg["current-profile"] = name
+		}
+		return nil
+	})
+}
+
+func profileDelete(name string) error {
+	name = normalizeProfileName(name)
+	return updateConfig(func(cfg map[string]interface{}) error {
+		if !unsetConfigValue(cfg, "profiles."+name) {
+			return notFoundError(fmt.Errorf("profile %q not found", name))
+		}
+		if cfg["current-profile"] == name {
+			delete(cfg, "current-profile")
+		}
+		return nil
+	})
+}
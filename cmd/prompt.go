@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	xterm "golang.org/x/term"
+)
+
+// promptLine reads a line typed by the user, without the line ending and
+// surrounding spaces.
+func promptLine(ctx context.Context) (string, error) {
+	line, err := readPrompt(ctx, readStdinLine)
+	return strings.TrimSpace(string(line)), err
+}
+
+// promptPassword reads a line typed by the user without echoing it.
+func promptPassword(ctx context.Context) ([]byte, error) {
+	return readPrompt(ctx, func() ([]byte, error) {
+		return xterm.ReadPassword(int(os.Stdin.Fd()))
+	})
+}
+
+// readPrompt returns what read returns, unless ctx is done first. Ctrl-C
+// cancels the context of the command instead of stopping ik, so a prompt
+// blocked on stdin would otherwise ignore it. read may change the terminal,
+// eg to hide a password, the terminal is restored when the prompt is
+// interrupted.
+func readPrompt(ctx context.Context, read func() ([]byte, error)) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	state, stateErr := xterm.GetState(fd)
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	// Buffered so the read can finish after the prompt was interrupted
+	done := make(chan result, 1)
+	go func() {
+		b, err := read()
+		done <- result{b, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.b, r.err
+	case <-ctx.Done():
+		if stateErr == nil {
+			xterm.Restore(fd, state)
+		}
+		// End the line of the prompt
+		fmt.Fprintln(os.Stderr)
+		return nil, interruptedError()
+	}
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Size of recordings of sessions without a terminal
+const (
+	defaultRecordWidth  = 80
+	defaultRecordHeight = 24
+)
+
+// asciicastHeader is the first line of an asciicast v2 recording, see
+// https://docs.asciinema.org/manual/asciicast/v2/
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Types of the events of an asciicast recording
+const (
+	asciicastOutput = "o"
+	asciicastInput  = "i"
+	asciicastResize = "r"
+)
+
+// recorder writes a debug session to a file in the asciicast v2 format. The
+// output, the input and resizes of the terminal are recorded. It is safe for
+// concurrent use.
+type recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	start time.Time
+	// Bytes of an incomplete UTF-8 character at the end of the last write
+	// of each event type, they are recorded with the next write
+	pending map[string][]byte
+	err     error
+	// Events after Close are dropped, eg output read while ik exits
+	closed bool
+}
+
+// newRecorder creates the recording path of a terminal of width by height.
+// Recordings contain everything typed in the session, so the file is only
+// readable by the user.
+func newRecorder(path string, width, height int, title string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the recording: %s", err)
+	}
+	if width <= 0 || height <= 0 {
+		width, height = defaultRecordWidth, defaultRecordHeight
+	}
+	r := &recorder{
+		file:    file,
+		w:       bufio.NewWriter(file),
+		start:   time.Now(),
+		pending: map[string][]byte{},
+	}
+	header := asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+	if err := r.writeLine(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Output records p as printed by the session.
+func (r *recorder) Output(p []byte) {
+	r.event(asciicastOutput, p)
+}
+
+// Input records p as typed by the user.
+func (r *recorder) Input(p []byte) {
+	r.event(asciicastInput, p)
+}
+
+// Resize records a new size of the terminal.
+func (r *recorder) Resize(width, height int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(asciicastResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes the recording and closes the file. It returns the first error
+// that happened while recording.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	for _, eventType := range []string{asciicastOutput, asciicastInput} {
+		if pending := r.pending[eventType]; len(pending) > 0 {
+			r.add(eventType, string(pending))
+		}
+	}
+	if err := r.w.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if err := r.file.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	r.closed = true
+	if r.err != nil {
+		return fmt.Errorf("failed to write the recording: %s", r.err)
+	}
+	return nil
+}
+
+func (r *recorder) event(eventType string, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.pending[eventType], p...)
+	// Events are JSON strings, a character split between two reads is
+	// recorded once it is complete
+	n := completeUTF8(data)
+	r.pending[eventType] = append([]byte(nil), data[n:]...)
+	if n > 0 {
+		r.add(eventType, string(data[:n]))
+	}
+}
+
+// add writes an event, the caller holds r.mu. Recording stops at the first
+// error so a full disk doesn't end the session.
+func (r *recorder) add(eventType, data string) {
+	if r.err != nil || r.closed {
+		return
+	}
+	r.err = r.writeLine([]interface{}{time.Since(r.start).Seconds(), eventType, data})
+	if r.err == nil && eventType != asciicastInput {
+		// Keep the recording up to date in case ik is killed
+		r.err = r.w.Flush()
+	}
+}
+
+func (r *recorder) writeLine(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(append(b, '\n'))
+	return err
+}
+
+// completeUTF8 returns the length of p without an incomplete UTF-8 character
+// at its end. Invalid bytes are not held back.
+func completeUTF8(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(p[i]) {
+			continue
+		}
+		if !utf8.FullRune(p[i:]) {
+			return i
+		}
+		break
+	}
+	return len(p)
+}
+
+// recordReader records everything read from In as input
+type recordReader struct {
+	In       io.Reader
+	recorder *recorder
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.In.Read(p)
+	if n > 0 {
+		r.recorder.Input(p[:n])
+	}
+	return n, err
+}
+
+// recordWriter records everything written to Out as output
+type recordWriter struct {
+	Out      io.Writer
+	recorder *recorder
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.recorder.Output(p)
+	return w.Out.Write(p)
+}
+
+// recordSizeQueue records the sizes returned by a TerminalSizeQueue
+type recordSizeQueue struct {
+	remotecommand.TerminalSizeQueue
+	recorder *recorder
+}
+
+func (q *recordSizeQueue) Next() *remotecommand.TerminalSize {
+	size := q.TerminalSizeQueue.Next()
+	if size != nil {
+		q.recorder.Resize(int(size.Width), int(size.Height))
+	}
+	return size
+}
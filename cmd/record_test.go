@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	rec, err := newRecorder(path, 80, 24, "vpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var live bytes.Buffer
+	out := &recordWriter{Out: &live, recorder: rec}
+	in := &recordReader{In: strings.NewReader("ls\n"), recorder: rec}
+
+	// "é" and "✓" are split between writes, as reads of the session may
+	// split them
+	output := "héllo ✓\nmain.tf\n"
+	for _, chunk := range []string{"h\xc3", "\xa9llo \xe2\x9c", "\x93\n"} {
+		if _, err := out.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := in.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	rec.Resize(120, 40)
+	if _, err := out.Write([]byte("main.tf\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if live.String() != output {
+		t.Errorf("got live output %q, want %q", live.String(), output)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("the recording is empty")
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Title != "vpc" {
+		t.Errorf("got header %+v", header)
+	}
+	var recorded string
+	var types []string
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		eventType, data := event[1].(string), event[2].(string)
+		if strings.ContainsRune(data, utf8.RuneError) {
+			t.Errorf("%s event %q has a broken character", eventType, data)
+		}
+		switch eventType {
+		case asciicastOutput:
+			recorded += data
+		case asciicastInput:
+			if data != "ls\n" {
+				t.Errorf("got input %q, want %q", data, "ls\n")
+			}
+		case asciicastResize:
+			if data != "120x40" {
+				t.Errorf("got resize %q, want 120x40", data)
+			}
+		}
+		if len(types) == 0 || types[len(types)-1] != eventType {
+			types = append(types, eventType)
+		}
+	}
+	if recorded != output {
+		t.Errorf("got recorded output %q, want %q", recorded, output)
+	}
+	if got, want := strings.Join(types, ","), "o,i,r,o"; got != want {
+		t.Errorf("got events %s, want %s", got, want)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	var replayed bytes.Buffer
+	if err := replay(context.Background(), f, &replayed, &ReplayOptions{Speed: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.String() != output {
+		t.Errorf("got replayed output %q, want %q", replayed.String(), output)
+	}
+}
+
+func TestReplayInvalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":      "",
+		"v1":         `{"version": 1, "width": 80, "height": 24}`,
+		"bad event":  "{\"version\": 2, \"width\": 80, \"height\": 24}\n[0.1, \"o\"]\n",
+		"not json":   "{\"version\": 2, \"width\": 80, \"height\": 24}\nhello\n",
+		"bad header": "hello\n",
+	}
+	for name, recording := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := replay(context.Background(), strings.NewReader(recording), &bytes.Buffer{}, &ReplayOptions{Speed: 1})
+			if ExitCode(err) != ExitUsage {
+				t.Errorf("got %v (exit code %d), want exit code %d", err, ExitCode(err), ExitUsage)
+			}
+		})
+	}
+}
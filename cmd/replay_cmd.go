@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	xterm "golang.org/x/term"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <file>",
+	Short: "Play a session recorded with --record",
+	Long: `Plays a session recorded by 'ik exec --record' or 'ik local debug --record', or
+any other asciicast v2 recording, in the terminal. Use --speed to play it faster
+and --idle-time-limit to skip long pauses.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if replayOpts.Speed <= 0 {
+			return usageError(fmt.Errorf("`--speed` must be greater than 0"))
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if errors.Is(err, os.ErrNotExist) {
+			return notFoundError(err)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return replay(cmd.Context(), f, os.Stdout, replayOpts)
+	},
+}
+
+// ReplayOptions are the options of `ik replay`
+type ReplayOptions struct {
+	// Speed multiplies the speed of the recording, 2 plays it twice as fast
+	Speed float64
+	// IdleTimeLimit caps the pauses between events, they are kept as
+	// recorded when it is 0
+	IdleTimeLimit time.Duration
+}
+
+var replayOpts = &ReplayOptions{}
+
+func init() {
+	replayCmd.Flags().Float64Var(&replayOpts.Speed, "speed", 1, "Playback speed, eg 2 plays the recording twice as fast")
+	replayCmd.Flags().DurationVarP(&replayOpts.IdleTimeLimit, "idle-time-limit", "i", 0, "Shorten pauses longer than this, eg 2s")
+	rootCmd.AddCommand(replayCmd)
+}
+
+// replay writes the output events of the asciicast v2 recording r to w with
+// the recorded timing. Input and resize events are skipped.
+func replay(ctx context.Context, r io.Reader, w io.Writer, o *ReplayOptions) error {
+	scanner := bufio.NewScanner(r)
+	// Events hold whatever was read at once, allow for large ones
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return usageError(fmt.Errorf("the recording is empty"))
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return usageError(fmt.Errorf("invalid recording header: %s", err))
+	}
+	if header.Version != 2 {
+		return usageError(fmt.Errorf("unsupported asciicast version %d, only version 2 can be replayed", header.Version))
+	}
+	if f, ok := w.(*os.File); ok && xterm.IsTerminal(int(f.Fd())) {
+		columns, rows, err := xterm.GetSize(int(f.Fd()))
+		if err == nil && (columns < header.Width || rows < header.Height) {
+			fmt.Fprintf(os.Stderr, "warning: the recording is %dx%d, larger than the terminal (%dx%d)\n", header.Width, header.Height, columns, rows)
+		}
+	}
+
+	start := time.Now()
+	// Time of the last event in the recording and in the playback, which
+	// differ once pauses are shortened
+	var last, played time.Duration
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return usageError(fmt.Errorf("invalid event on line %d: %s", line, err))
+		}
+		if len(event) != 3 {
+			return usageError(fmt.Errorf("invalid event on line %d", line))
+		}
+		seconds, ok := event[0].(float64)
+		if !ok {
+			return usageError(fmt.Errorf("invalid event on line %d", line))
+		}
+		eventType, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if eventType != asciicastOutput {
+			continue
+		}
+
+		at := time.Duration(seconds * float64(time.Second))
+		pause := at - last
+		if o.IdleTimeLimit > 0 && pause > o.IdleTimeLimit {
+			pause = o.IdleTimeLimit
+		}
+		last = at
+		played += pause
+		if wait := time.Duration(float64(played)/o.Speed) - time.Since(start); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -1,21 +1,20 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
-	infrakube "github.com/galleybytes/infrakube/pkg/client/clientset/versioned"
 	"github.com/ghodss/yaml"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"k8s.io/client-go/kubernetes"
-	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+	xterm "golang.org/x/term"
 	"k8s.io/client-go/util/homedir"
 )
 
@@ -23,67 +22,81 @@ var (
 	rootCmd = &cobra.Command{
 		Use:     "ik",
 		Aliases: []string{"\"kubectl tf(o)\""},
-		Short:   "Terraform Operator (ik) CLI -- Manage TFO deployments",
+		Short:   "Infrakube (ik) CLI -- Manage Infrakube deployments",
 		Args:    cobra.MaximumNArgs(0),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if isCompletionCommand(cmd) {
+				// Completion functions load the config themselves, without
+				// prompting
+				return nil
+			}
+			if cmd == replayCmd {
+				// Recordings are replayed without a config, eg by someone
+				// reviewing a session
+				return nil
+			}
+			return loadConfig(cmd)
+		},
+		SilenceUsage:  true,
+		SilenceErrors: true,
 	}
 )
 
 var (
-	// vars used for flags
-	host                string
+	// vars used for the persistent flags of rootCmd
 	kubeconfig          string
 	namespace           string
 	infrakubeConfigFile string
-	clientName          string
-	token               string
-	username            string
-	command             []string
-
-	session Session
+	profileName         string
+	nonInteractive      bool
+	assumeYes           bool
+	requestTimeout      time.Duration
 
-	// show only flags
-	allNamespaces bool
+	// factory builds the cluster clients for local commands
+	factory = NewFactory(kubeConfigFlags)
 )
 
 func init() {
-	cobra.OnInitialize(newSession)
-	getKubeconfig()
+	rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubecfg", "", "absolute path to the kubeconfig file")
+	rootCmd.PersistentFlags().MarkDeprecated("kubecfg", "use --kubeconfig instead")
 	rootCmd.PersistentFlags().StringVar(&infrakubeConfigFile, "config", "", "absolute path to config file (default is $HOME/.ik/config)")
 	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 	rootCmd.PersistentFlags().StringVarP(&namespace, "namespace", "n", "", "namespace to add Kubernetes creds secret")
+	rootCmd.PersistentFlags().BoolVar(&nonInteractive, "non-interactive", false, "never prompt for input, fail instead (default when stdin is not a terminal)")
+	rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "answer yes to confirmation prompts, eg creating the config file. Implies --non-interactive")
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "name of the profile to use (default is the config's current-profile)")
+	rootCmd.PersistentFlags().DurationVar(&requestTimeout, "request-timeout", defaultRequestTimeout, "how long to wait for a single request to the API or the cluster, 0 waits forever")
 
-	rootCmd.CompletionOptions.DisableDefaultCmd = true
-}
-
-type Session struct {
-	config             *rest.Config
-	infrakubeclientset infrakube.Interface
-	clientset          kubernetes.Interface
-	namespace          string
+	rootCmd.RegisterFlagCompletionFunc("namespace", completeNamespaces)
 }
 
-func newSession() {
+// loadConfig reads the ik config and applies the active profile to the
+// kubeconfig flags. Cluster clients are built later by the factory when a
+// command needs them. The active profile must exist unless cmd manages
+// profiles.
+func loadConfig(cmd *cobra.Command) error {
 
-	viper.SetEnvPrefix("TFO")
+	viper.SetEnvPrefix("IK")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	viper.AutomaticEnv()
 
-	// Load from global config first, will be ignored if does not exist
+	// Load from global config first, will be ignored if does not exist. Values
+	// in the user's config are merged on top of it.
 	viper.SetConfigName("global")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath("$HOME/.ik")
-	if err := viper.ReadInConfig(); err == nil {
-		if host == "" {
-			host = viper.GetString("host")
-		}
-	}
+	viper.ReadInConfig()
 
 	viper.SetConfigType("yaml")
 	infrakubeConfigFile = viper.GetString("config")
+	if infrakubeConfigFile == "" {
+		// IK_CONFIG is read by viper, this picks up TFO_CONFIG
+		infrakubeConfigFile = getEnv("config")
+	}
 
 	if infrakubeConfigFile != "" {
 		viper.SetConfigFile(infrakubeConfigFile)
 		infrakubeConfigFileType := filepath.Ext(infrakubeConfigFile)
-		log.Println(infrakubeConfigFile, infrakubeConfigFileType)
 		if infrakubeConfigFileType == "" {
 			viper.SetConfigFile(infrakubeConfigFileType)
 		}
@@ -97,137 +110,204 @@ func newSession() {
 		}
 	}
 
-	if readErr := viper.ReadInConfig(); readErr != nil {
-		err := createConfigFile(infrakubeConfigFile)
-		if err != nil {
-			log.Print(err)
-			os.Exit(0)
+	if readErr := viper.MergeInConfig(); readErr != nil {
+		ctx := context.Background()
+		if cmd != nil {
+			ctx = cmd.Context()
 		}
-		if readErr := viper.ReadInConfig(); readErr != nil {
-			log.Fatal(err)
+		if err := createConfigFile(ctx, infrakubeConfigFile); err != nil {
+			return err
+		}
+		if readErr := viper.MergeInConfig(); readErr != nil {
+			return usageError(readErr)
 		}
 	}
 
 	// Config file found and successfully parsed
 
-	// Get the namespace from the user's contexts when not passed in via flag
-	kubeConfig, _ := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if kubeConfig != nil && namespace == "" {
-		// Define the schema of the kubeconfig that is meaningful to extract
-		// the current-context's namespace (if defined)
-		type kubecfgContext struct {
-			Namespace string `json:"namespace"`
-		}
-		type kubecfgContexts struct {
-			Name    string         `json:"name"`
-			Context kubecfgContext `json:"context"`
-		}
-		type kubecfg struct {
-			CurrentContext string            `json:"current-context"`
-			Contexts       []kubecfgContexts `json:"contexts"`
-		}
-		// As a kubectl plugin, it's nearly guaranteed a kubeconfig is used
-		b, err := ioutil.ReadFile(kubeconfig)
-		if err != nil {
-			panic(err)
-		}
-		kubecfgCtx := kubecfg{}
-		yaml.Unmarshal(b, &kubecfgCtx)
-		for _, item := range kubecfgCtx.Contexts {
-			if item.Name == kubecfgCtx.CurrentContext {
-				namespace = item.Context.Namespace
-				break
-			}
-		}
-		if namespace == "" {
-			namespace = "default"
-		}
+	// Profiles are only created by `ik profile add`. Commands that manage
+	// profiles still run, so a stale current-profile can be fixed.
+	if name := activeProfile(); name != "" && !profileExists(name) && !managesProfiles(cmd) {
+		return notFoundError(fmt.Errorf("profile %q not found. Add it with `ik profile add %s`", name, name))
 	}
 
-	if kubeConfig != nil {
-
-		clientset, err := kubernetes.NewForConfig(kubeConfig)
-		if err != nil {
-			panic(err)
-		}
-
-		infrakubeclientset, err := infrakube.NewForConfig(kubeConfig)
-		if err != nil {
-			panic(err)
-		}
-		session.clientset = clientset
-		session.infrakubeclientset = infrakubeclientset
-		session.namespace = namespace
-		session.config = kubeConfig
+	// The deprecated --kubecfg flag is used when --kubeconfig is not set
+	if *kubeConfigFlags.KubeConfig == "" {
+		*kubeConfigFlags.KubeConfig = kubeconfig
 	}
-
+	// Use the profile's kube context when one is set, otherwise the
+	// kubeconfig's current-context
+	if *kubeConfigFlags.Context == "" {
+		*kubeConfigFlags.Context = configString("context")
+	}
+	return nil
 }
 
-func getKubeconfig() {
-	if home := homedir.HomeDir(); home != "" {
-		rootCmd.PersistentFlags().StringVarP(&kubeconfig, "kubecfg", "", "", "(optional) absolute path to the kubeconfig file")
-		if kubeconfig == "" {
-			kubeconfig = os.Getenv("KUBECONFIG")
-			if kubeconfig == "" {
-				kubeconfig = filepath.Join(home, ".kube", "config")
-			}
-		}
-	} else {
-		rootCmd.PersistentFlags().StringVarP(&kubeconfig, "kubecfg", "", "", "absolute path to the kubeconfig file")
-		if kubeconfig == "" {
-			kubeconfig = os.Getenv("KUBECONFIG")
-		}
+// resolveNamespace returns the namespace from the `--namespace` flag, the
+// active profile or the kubeconfig's current context, in that order.
+func resolveNamespace(f Factory) string {
+	if namespace != "" {
+		return namespace
+	}
+	if value := configString("namespace"); value != "" {
+		return value
 	}
+	value, err := f.Namespace()
+	if err != nil || value == "" {
+		return "default"
+	}
+	return value
+}
 
+// isInteractive reports whether ik may prompt the user. Prompts are disabled by
+// `--non-interactive` or `--yes` and when stdin is not a terminal, eg in CI.
+func isInteractive() bool {
+	if nonInteractive || assumeYes {
+		return false
+	}
+	return xterm.IsTerminal(int(os.Stdin.Fd()))
 }
 
-func createConfigFile(name string) error {
+// createConfigFile creates an empty config file at name after asking the
+// user, unless `--yes` was passed. The prompt is interrupted when ctx is done.
+func createConfigFile(ctx context.Context, name string) error {
 	if name == "" {
-		return fmt.Errorf("no config file defined")
+		return usageError(fmt.Errorf("no config file defined"))
 	}
 	fileInfo, err := os.Stat(name)
 
 	if err != nil {
-		createCh := make(chan bool)
-		go func() {
+		create := assumeYes
+		if !create {
+			if !isInteractive() {
+				return usageError(fmt.Errorf("config file '%s' does not exist. Create it or pass `--yes` to create it", name))
+			}
 			for {
-				var stringbool string
 				fmt.Printf("Do you want to create '%s' (Y/n): ", name)
-				fmt.Scanln(&stringbool)
-
-				if strings.HasPrefix(strings.ToLower(stringbool), "y") {
-					createCh <- true
-					return
+				answer, err := promptLine(ctx)
+				if err != nil {
+					return err
 				}
-				if strings.HasPrefix(strings.ToLower(stringbool), "n") {
-					createCh <- false
-					return
+				answer = strings.ToLower(answer)
+				if strings.HasPrefix(answer, "y") || strings.HasPrefix(answer, "n") {
+					create = strings.HasPrefix(answer, "y")
+					break
 				}
-
 			}
-		}()
-
-		create := <-createCh
+		}
 		if !create {
-			return fmt.Errorf("select a config file with `--config`")
+			return usageError(fmt.Errorf("select a config file with `--config`"))
 		}
 		err = os.MkdirAll(filepath.Dir(name), 0755)
 		if err != nil {
 			return fmt.Errorf("failed to create dir: %s", err)
 		}
-		_, err = os.Create(name)
-		return err
+		return writePrivateFile(name, nil)
 
 	}
 
 	if fileInfo.IsDir() {
-		return fmt.Errorf("config file %s expected a file but is a dir", name)
+		return usageError(fmt.Errorf("config file %s expected a file but is a dir", name))
 	}
 	return nil
 
 }
 
+// updateConfig reads the config file in use, lets fn modify it and writes it
+// back. Viper is re-read afterwards so new values are visible immediately.
+func updateConfig(fn func(cfg map[string]interface{}) error) error {
+	cfg, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := fn(cfg); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err := writePrivateFile(viper.ConfigFileUsed(), b); err != nil {
+		return err
+	}
+	return viper.MergeInConfig()
+}
+
+// setConfigValue sets a dot separated key in cfg, creating nested maps as
+// needed.
+func setConfigValue(cfg map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	m := cfg
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := m[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[part] = next
+		}
+		m = next
+	}
+	m[parts[len(parts)-1]] = value
+}
+
+// unsetConfigValue removes a dot separated key from cfg and reports whether
+// it existed.
+func unsetConfigValue(cfg map[string]interface{}, key string) bool {
+	parts := strings.Split(key, ".")
+	m := cfg
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := m[part].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		m = next
+	}
+	if _, ok := m[parts[len(parts)-1]]; !ok {
+		return false
+	}
+	delete(m, parts[len(parts)-1])
+	return true
+}
+
+// Default of `--request-timeout`
+const defaultRequestTimeout = 30 * time.Second
+
+// withRequestTimeout returns a context for a single request to the API or the
+// cluster, which is cancelled after timeout. It never is when timeout is 0.
+func withRequestTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Execute runs the root command and prints any error returned. Use ExitCode
+// to get the exit code for the error.
 func Execute(v string) error {
 	version = v
-	return rootCmd.Execute()
+	setupCommands()
+	wrapArgsErrors(rootCmd)
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError(err)
+	})
+
+	// The context of every command is cancelled by Ctrl-C. Once it is, the
+	// signals are no longer caught so pressing Ctrl-C again exits right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	if err != nil && ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		err = interruptedError()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		if ExitCode(err) == ExitUsage {
+			fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", cmd.CommandPath())
+		}
+	}
+	return err
 }
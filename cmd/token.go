@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
+)
+
+// Commands warn when the token expires within tokenExpiryWarning
+const tokenExpiryWarning = 15 * time.Minute
+
+// refreshCredentialKey is the key of the refresh token of host in the
+// credential store. The fragment keeps it from clashing with a host.
+func refreshCredentialKey(host string) string {
+	return credentialKey(host) + "#refresh"
+}
+
+// saveToken saves t in the credential store for host. A refresh token left
+// from a previous login is removed when t doesn't have one.
+func saveToken(ctx context.Context, host string, t *stella.Token) error {
+	store, err := newCredentialStore(ctx)
+	if err != nil {
+		return err
+	}
+	if err := store.Set(host, t.Token); err != nil {
+		return err
+	}
+	if t.RefreshToken == "" {
+		return store.Delete(refreshCredentialKey(host))
+	}
+	return store.Set(refreshCredentialKey(host), t.RefreshToken)
+}
+
+// tokenClaims returns the claims of a JWT, or false when token is not a JWT.
+// The signature is not verified, the claims are only used for display.
+func tokenClaims(token string) (map[string]interface{}, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var claims map[string]interface{}
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// tokenExpiry returns the "exp" claim of a JWT. Tokens that are not JWTs or
+// have no expiry return false.
+func tokenExpiry(token string) (time.Time, bool) {
+	claims, ok := tokenClaims(token)
+	if !ok {
+		return time.Time{}, false
+	}
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := exp.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// tokenSubject returns the user a JWT was issued to.
+func tokenSubject(token string) string {
+	claims, _ := tokenClaims(token)
+	for _, claim := range []string{"preferred_username", "username", "email", "sub"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// checkToken warns when the token of o.Host is about to expire and gets a new
+// one when it has expired. Tokens from IK_TOKEN or a credential helper are
+// returned as is.
+func checkToken(ctx context.Context, o *ConnectOptions, token string) (string, error) {
+	if externalTokenSource() != "" {
+		return token, nil
+	}
+	exp, ok := tokenExpiry(token)
+	if !ok {
+		return token, nil
+	}
+	switch remaining := time.Until(exp); {
+	case remaining <= 0:
+		fmt.Fprintf(os.Stderr, "The token for %s expired at %s\n", o.Host, exp.Local().Format(time.RFC1123))
+		return reauthenticate(ctx, o)
+	case remaining < tokenExpiryWarning:
+		fmt.Fprintf(os.Stderr, "warning: the token for %s expires in %s. Run `ik connect` to renew it\n", o.Host, remaining.Round(time.Second))
+	}
+	return token, nil
+}
+
+// reauthenticate gets a new token for o.Host after the current one expired or
+// was rejected. The refresh token is used when there is one, otherwise the
+// host's connecter is run again.
+func reauthenticate(ctx context.Context, o *ConnectOptions) (string, error) {
+	if source := externalTokenSource(); source != "" {
+		return "", authError(fmt.Errorf("the token from %s was rejected", source))
+	}
+	store, err := newCredentialStore(ctx)
+	if err != nil {
+		return "", err
+	}
+	refreshToken, err := store.Get(refreshCredentialKey(o.Host))
+	if err != nil {
+		return "", err
+	}
+	if refreshToken != "" {
+		t, err := refreshConnecter(ctx, o, refreshToken)
+		if err == nil {
+			if err := saveToken(ctx, o.Host, t); err != nil {
+				return "", err
+			}
+			return t.Token, nil
+		}
+		if !errors.Is(err, stella.ErrNotSupported) && ExitCode(err) != ExitAuth {
+			return "", err
+		}
+		// The refresh token is no good anymore, log in again instead
+		if err := store.Delete(refreshCredentialKey(o.Host)); err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Connecting to %s again\n", o.Host)
+	if err := connect(ctx, o); err != nil {
+		return "", err
+	}
+	return lookupToken(ctx, o.Host)
+}
+
+// refreshConnecter exchanges refreshToken for a new token. APIs without a
+// refresh endpoint return stella.ErrNotSupported.
+func refreshConnecter(ctx context.Context, o *ConnectOptions, refreshToken string) (*stella.Token, error) {
+	client, err := newStellaClient(o.Host, &o.Transport)
+	if err != nil {
+		return nil, err
+	}
+	t, err := client.Refresh(ctx, refreshToken)
+	if err != nil && !errors.Is(err, stella.ErrNotSupported) {
+		return nil, stellaError(err)
+	}
+	return t, err
+}
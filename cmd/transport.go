@@ -0,0 +1,376 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/isaaguilar/infrakube-cli/pkg/stella"
+	"github.com/spf13/pflag"
+)
+
+// TransportOptions configure how ik connects to the API server: how the server
+// is verified, how ik authenticates to it with a client certificate, the proxy
+// in between and extra headers sent with every request. Certificates are always
+// verified unless InsecureSkipTLSVerify is set.
+type TransportOptions struct {
+	// CertificateAuthority is a PEM bundle trusted in addition to the system
+	// roots
+	CertificateAuthority  string
+	ClientCertificate     string
+	ClientKey             string
+	InsecureSkipTLSVerify bool
+	// ProxyURL is an http, https or socks5 proxy. HTTPS_PROXY and NO_PROXY
+	// are used when it is not set.
+	ProxyURL string
+	// Headers are "Name: value" pairs added to every request, eg for an auth
+	// gateway in front of the API
+	Headers []string
+	// RequestTimeout limits each request to the API and the handshake of
+	// websockets, 0 waits forever
+	RequestTimeout time.Duration
+}
+
+func addTransportFlags(flags *pflag.FlagSet, o *TransportOptions) {
+	flags.StringVar(&o.CertificateAuthority, "certificate-authority", "", "Path to a CA bundle used to verify the API server")
+	flags.StringVar(&o.ClientCertificate, "client-certificate", "", "Path to a client certificate for mTLS with the API")
+	flags.StringVar(&o.ClientKey, "client-key", "", "Path to the key of the client certificate")
+	flags.BoolVar(&o.InsecureSkipTLSVerify, "insecure-skip-tls-verify", false, "Don't verify the certificate of the API server. Tokens and passwords can be read by anyone in between")
+	flags.StringVar(&o.ProxyURL, "proxy-url", "", "http, https or socks5 proxy for the API (default is HTTPS_PROXY unless the host is in NO_PROXY)")
+	flags.StringArrayVar(&o.Headers, "header", nil, "Extra header sent to the API as 'Name: value'. Can be repeated")
+}
+
+// completeTransportOptions reads the options that were not set by flags from
+// the config, so they can be set per profile. The request timeout is the one
+// of `--request-timeout`.
+func completeTransportOptions(flags *pflag.FlagSet, o *TransportOptions) error {
+	o.RequestTimeout = requestTimeout
+	if o.CertificateAuthority == "" {
+		o.CertificateAuthority = configString("certificate-authority")
+	}
+	if o.ClientCertificate == "" {
+		o.ClientCertificate = configString("client-certificate")
+	}
+	if o.ClientKey == "" {
+		o.ClientKey = configString("client-key")
+	}
+	if !flags.Changed("insecure-skip-tls-verify") {
+		if value := configString("insecure-skip-tls-verify"); value != "" {
+			insecure, err := strconv.ParseBool(value)
+			if err != nil {
+				return usageError(fmt.Errorf("insecure-skip-tls-verify: expected true or false, got %q", value))
+			}
+			o.InsecureSkipTLSVerify = insecure
+		}
+	}
+
+	if (o.ClientCertificate == "") != (o.ClientKey == "") {
+		return usageError(fmt.Errorf("`--client-certificate` and `--client-key` must be set together"))
+	}
+	if o.InsecureSkipTLSVerify && o.CertificateAuthority != "" {
+		return usageError(fmt.Errorf("`--certificate-authority` can not be used with `--insecure-skip-tls-verify`"))
+	}
+	if o.InsecureSkipTLSVerify {
+		fmt.Fprintln(os.Stderr, "warning: the certificate of the API server is not verified")
+	}
+
+	if o.ProxyURL == "" {
+		o.ProxyURL = configString("proxy-url")
+	}
+	if _, err := o.proxy(); err != nil {
+		return err
+	}
+	// Headers from flags replace the config's headers with the same name
+	header, err := o.header()
+	if err != nil {
+		return err
+	}
+	configHeaders := configStringMap("headers")
+	var names []string
+	for name := range configHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if header.Get(name) == "" {
+			o.Headers = append(o.Headers, name+": "+configHeaders[name])
+		}
+	}
+	_, err = o.header()
+	return err
+}
+
+// proxy returns the proxy of every request to the API.
+func (o *TransportOptions) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if o.ProxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(o.ProxyURL)
+	if err != nil {
+		return nil, usageError(fmt.Errorf("proxy-url: %s", err))
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, usageError(fmt.Errorf("proxy-url: expected an http, https or socks5 URL, got %q", o.ProxyURL))
+	}
+	if proxyURL.Host == "" {
+		return nil, usageError(fmt.Errorf("proxy-url: missing the hostname in %q", o.ProxyURL))
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// header returns the extra headers of every request to the API.
+func (o *TransportOptions) header() (http.Header, error) {
+	header := http.Header{}
+	for _, h := range o.Headers {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, usageError(fmt.Errorf("header: expected 'Name: value', got %q", h))
+		}
+		header.Set(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+func (o *TransportOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipTLSVerify,
+	}
+	if o.CertificateAuthority != "" {
+		b, err := os.ReadFile(o.CertificateAuthority)
+		if err != nil {
+			return nil, usageError(fmt.Errorf("failed to read the certificate authority: %s", err))
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, usageError(fmt.Errorf("no certificates were found in %s", o.CertificateAuthority))
+		}
+		config.RootCAs = pool
+	}
+	if o.ClientCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCertificate, o.ClientKey)
+		if err != nil {
+			return nil, usageError(fmt.Errorf("failed to load the client certificate: %s", err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newTransport returns the transport of every request to the API. Requests are
+// retried on transient errors.
+func newTransport(o *TransportOptions) (http.RoundTripper, error) {
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := o.proxy()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	return &retryTransport{next: transport}, nil
+}
+
+// newHTTPClient returns the client used for requests to the API, which time
+// out after o.RequestTimeout.
+func newHTTPClient(o *TransportOptions) (*http.Client, error) {
+	transport, err := newTransport(o)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   o.RequestTimeout,
+	}, nil
+}
+
+// newStellaClient returns a client for the API at host with the settings of
+// o.
+func newStellaClient(host string, o *TransportOptions) (*stella.Client, error) {
+	httpClient, err := newHTTPClient(o)
+	if err != nil {
+		return nil, err
+	}
+	header, err := o.header()
+	if err != nil {
+		return nil, err
+	}
+	client := stella.NewClient(host, httpClient)
+	client.Header = header
+	if version != "" {
+		client.UserAgent = "ik/" + version
+	}
+	return client, nil
+}
+
+// stellaError converts the errors of the stella client to typed errors.
+func stellaError(err error) error {
+	var statusErr *stella.StatusError
+	if errors.As(err, &statusErr) {
+		return apiError(statusErr.StatusCode, statusErr.Message)
+	}
+	return tlsError(err)
+}
+
+// newWebsocketDialer returns a dialer for the API's websockets with the same
+// TLS and proxy settings as newHTTPClient.
+func newWebsocketDialer(o *TransportOptions) (*websocket.Dialer, error) {
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := o.proxy()
+	if err != nil {
+		return nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	dialer.Proxy = proxy
+	if o.RequestTimeout > 0 {
+		dialer.HandshakeTimeout = o.RequestTimeout
+	}
+	return &dialer, nil
+}
+
+// tlsError adds a hint to certificate verification errors.
+func tlsError(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname) {
+		return fmt.Errorf("%w. Use `--certificate-authority` to trust the API's CA", err)
+	}
+	return err
+}
+
+// Failed requests are retried up to maxRetries times. The first retry waits
+// retryBackoff, which doubles after each attempt up to maxRetryWait.
+const (
+	maxRetries   = 3
+	retryBackoff = 500 * time.Millisecond
+	maxRetryWait = 10 * time.Second
+)
+
+// retryTransport retries requests that failed with a transient error: a
+// connection that could not be opened or was reset, 429 Too Many Requests, or
+// 502, 503 and 504 from a proxy or load balancer. Requests that are not
+// idempotent are only retried when they can't have reached the server.
+type retryTransport struct {
+	next http.RoundTripper
+	// throttledOnly only retries 429 Too Many Requests, which was not
+	// processed. client-go handles the other failures of requests to the
+	// cluster, and exec upgrades must not be replayed after a reset.
+	throttledOnly bool
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	wait := retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt == maxRetries || !t.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		delay := wait
+		if resp != nil {
+			if retryAfter := retryAfterDelay(resp); retryAfter > 0 {
+				delay = retryAfter
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if delay > maxRetryWait {
+			delay = maxRetryWait
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		wait *= 2
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// shouldRetry reports whether req can be sent again after it failed with err
+// or resp.
+func (t *retryTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The body can't be sent twice
+		return false
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+	if t.throttledOnly {
+		return err == nil && resp.StatusCode == http.StatusTooManyRequests
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return isIdempotent(req) && (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF))
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		// The request was not processed
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return isIdempotent(req)
+	}
+	return false
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryAfterDelay returns the delay of a Retry-After header in seconds, or 0
+// when there is none.
+func retryAfterDelay(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
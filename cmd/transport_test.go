@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyServer returns a server answering the first failures requests with
+// status, and the others with the body of the request. attempts counts the
+// requests.
+func newFlakyServer(t *testing.T, status, failures int, attempts *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(attempts, 1) <= int32(failures) {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRetryTransportMaxRetries(t *testing.T) {
+	var attempts int32
+	server := newFlakyServer(t, http.StatusServiceUnavailable, 10, &attempts)
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if attempts != maxRetries+1 {
+		t.Errorf("got %d attempts, want %d", attempts, maxRetries+1)
+	}
+}
+
+func TestRetryTransportReplaysBody(t *testing.T) {
+	var attempts int32
+	server := newFlakyServer(t, http.StatusTooManyRequests, 1, &attempts)
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport}}
+
+	// The request has GetBody since the body is a strings.Reader
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "payload" {
+		t.Errorf("got body %q on the retry, want %q", body, "payload")
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+}
+
+func TestRetryTransportNotIdempotent(t *testing.T) {
+	var attempts int32
+	server := newFlakyServer(t, http.StatusServiceUnavailable, 1, &attempts)
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport}}
+
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want a POST to be sent once after a 503", attempts)
+	}
+}
+
+func TestRetryTransportCancel(t *testing.T) {
+	var attempts int32
+	server := newFlakyServer(t, http.StatusServiceUnavailable, 10, &attempts)
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// Cancel while waiting for the first retry
+	time.AfterFunc(retryBackoff/5, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = client.Do(req)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed >= retryBackoff {
+		t.Errorf("returned after %s, want right after the cancel", elapsed)
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+}
+
+func TestRetryTransportThrottledOnly(t *testing.T) {
+	tests := []struct {
+		status       int
+		wantAttempts int32
+	}{
+		{http.StatusTooManyRequests, 2},
+		{http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			var attempts int32
+			server := newFlakyServer(t, tt.status, 1, &attempts)
+			client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, throttledOnly: true}}
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -12,6 +12,7 @@ require (
 	github.com/isaaguilar/kedge v0.0.0-20230623005919-25931c711d84
 	github.com/skratchdot/open-golang v0.0.0-20200116055534-eef842397966
 	github.com/spf13/cobra v1.9.1
+	github.com/spf13/pflag v1.0.6
 	github.com/spf13/viper v1.16.0
 	golang.org/x/term v0.32.0
 	k8s.io/api v0.33.1
@@ -132,11 +133,8 @@ require (
 )
 
 require (
-	github.com/atotto/clipboard v0.1.4
-	github.com/eiannone/keyboard v0.0.0-20220611211555-0d226195f203
 	github.com/ghodss/yaml v1.0.0
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/olekukonko/tablewriter v0.0.5
-	github.com/spf13/pflag v1.0.6 // indirect
 	k8s.io/client-go v0.33.1
 )
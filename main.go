@@ -10,7 +10,9 @@ import (
 var version string
 
 func main() {
-	cmd.Execute(version)
+	if err := cmd.Execute(version); err != nil {
+		os.Exit(cmd.ExitCode(err))
+	}
 }
 
 func init() {
@@ -0,0 +1,424 @@
+// Package stella is a client for the API of infrakube-stella, the server ik
+// connects to for logging in and for debug sessions.
+package stella
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/api"
+	"github.com/gorilla/websocket"
+)
+
+// Client calls the API at Host. A Client is safe for concurrent use as long
+// as its fields are not changed.
+type Client struct {
+	// Host is the URL of the API, eg https://stella.example.com
+	Host string
+	// Token authenticates requests, it is not needed to log in
+	Token string
+	// UserAgent is sent with every request
+	UserAgent string
+	// Header is added to every request, eg for an auth gateway in front of
+	// the API. Token and UserAgent take precedence over it.
+	Header http.Header
+
+	httpClient *http.Client
+}
+
+// NewClient returns a Client for the API at host. Requests are sent with
+// httpClient, or http.DefaultClient when it is nil.
+func NewClient(host string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		Host:       strings.TrimRight(host, "/"),
+		UserAgent:  "ik",
+		httpClient: httpClient,
+	}
+}
+
+// StatusError is returned when the API responds with a status other than 200.
+// StatusCode is the status_code of the response, or the HTTP status when the
+// response is not from the API.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return e.Message
+}
+
+// ErrNotSupported is returned by the methods of optional endpoints when the
+// API doesn't have them
+var ErrNotSupported = errors.New("not supported by the API")
+
+// Token is a token issued by the API. RefreshToken is only set when the API
+// supports refreshing tokens.
+type Token struct {
+	Token        string
+	RefreshToken string
+}
+
+// DeviceAuthorization is the response to a device login request, see RFC 8628
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// Errors of a pending device login, returned as the Message of a StatusError
+// by DeviceToken
+const (
+	DeviceAuthorizationPending = "authorization_pending"
+	DeviceSlowDown             = "slow_down"
+	DeviceAccessDenied         = "access_denied"
+	DeviceExpiredToken         = "expired_token"
+)
+
+// DebugRequest selects the Tf resource of a debug session
+type DebugRequest struct {
+	// ClientName is the cluster registered with the API
+	ClientName string
+	Namespace  string
+	// Name of the Tf resource to debug
+	Name string
+	// Command to run in the debug pod instead of an interactive shell
+	Command []string
+	// Term is the TERM of the local terminal, eg xterm-256color
+	Term string
+	// NoTTY runs the command without a pty, so its output is not mixed with
+	// the echo of its input. Used when ik is not run in a terminal.
+	NoTTY bool
+	// SessionID reattaches to a session opened before instead of starting a
+	// new one, eg after the connection dropped
+	SessionID string
+}
+
+// SessionIDHeader is the header of the websocket handshake response with the
+// ID of the debug session
+const SessionIDHeader = "Session-Id"
+
+// DebugSession is the websocket of a debug session
+type DebugSession struct {
+	*websocket.Conn
+	// ID is used to reattach to the session, it is empty when the server
+	// doesn't support reattaching
+	ID string
+}
+
+// Connecters returns the ways the API supports logging in, eg "login" or
+// "sso". The first one is the default.
+func (c *Client) Connecters(ctx context.Context) ([]string, error) {
+	data, err := c.do(ctx, http.MethodGet, "/connect", nil)
+	if err != nil {
+		return nil, err
+	}
+	connecters := names(data)
+	if len(connecters) == 0 {
+		return nil, fmt.Errorf("%s/connect did not return any connecters", c.Host)
+	}
+	return connecters, nil
+}
+
+// Login logs in with a username and password.
+func (c *Client) Login(ctx context.Context, username, password string) (*Token, error) {
+	data, err := c.do(ctx, http.MethodPost, "/login", struct {
+		Username string `json:"user"`
+		Password string `json:"password"`
+	}{Username: username, Password: password})
+	if err != nil {
+		return nil, err
+	}
+	return tokenFromData(data)
+}
+
+// Refresh exchanges a refresh token for a new token.
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*Token, error) {
+	data, err := c.do(ctx, http.MethodPost, "/refresh", struct {
+		RefreshToken string `json:"refresh_token"`
+	}{RefreshToken: refreshToken})
+	if err != nil {
+		return nil, optional(err)
+	}
+	return tokenFromData(data)
+}
+
+// SSOURL returns the URL of the SSO login page. The page redirects to
+// redirectURI with state and a code for ExchangeSSOCode.
+func (c *Client) SSOURL(redirectURI, state, codeChallenge string) string {
+	query := url.Values{
+		"redirect_uri":          {redirectURI},
+		"state":                 {state},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	return c.Host + "/sso?" + query.Encode()
+}
+
+// ExchangeSSOCode exchanges the code of an SSO login for a token, with the
+// PKCE verifier of the code challenge passed to SSOURL.
+func (c *Client) ExchangeSSOCode(ctx context.Context, code, codeVerifier, redirectURI string) (*Token, error) {
+	data, err := c.do(ctx, http.MethodPost, "/sso/token", struct {
+		Code         string `json:"code"`
+		CodeVerifier string `json:"code_verifier"`
+		RedirectURI  string `json:"redirect_uri"`
+	}{Code: code, CodeVerifier: codeVerifier, RedirectURI: redirectURI})
+	if err != nil {
+		return nil, err
+	}
+	return tokenFromData(data)
+}
+
+// DeviceCode starts a device login.
+func (c *Client) DeviceCode(ctx context.Context) (*DeviceAuthorization, error) {
+	data, err := c.do(ctx, http.MethodPost, "/device/code", nil)
+	if err != nil {
+		return nil, optional(err)
+	}
+	var authorization DeviceAuthorization
+	if err := decode(data, &authorization); err != nil {
+		return nil, err
+	}
+	if authorization.DeviceCode == "" || authorization.VerificationURI == "" {
+		return nil, fmt.Errorf("%s/device/code did not return a device code", c.Host)
+	}
+	return &authorization, nil
+}
+
+// DeviceToken returns the token of a device login once the user completed it.
+// Until then it returns a StatusError with DeviceAuthorizationPending.
+func (c *Client) DeviceToken(ctx context.Context, deviceCode string) (*Token, error) {
+	data, err := c.do(ctx, http.MethodPost, "/device/token", struct {
+		DeviceCode string `json:"device_code"`
+	}{DeviceCode: deviceCode})
+	if err != nil {
+		return nil, err
+	}
+	return tokenFromData(data)
+}
+
+// Revoke invalidates the client's token.
+func (c *Client) Revoke(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodPost, "/revoke", struct {
+		Token string `json:"token"`
+	}{Token: c.Token})
+	return optional(err)
+}
+
+// Clients returns the names of the clients (clusters) registered with the API.
+// APIs without the endpoint return ErrNotSupported.
+func (c *Client) Clients(ctx context.Context) ([]string, error) {
+	data, err := c.do(ctx, http.MethodGet, "/api/v1/clusters", nil)
+	if err != nil {
+		return nil, optional(err)
+	}
+	return names(data), nil
+}
+
+// DashboardPath is the path of the dashboard's page of the Tf resource name.
+// The home page of the dashboard is returned when name is empty.
+func DashboardPath(clientName, namespace, name string) string {
+	if name == "" {
+		return "/dashboard"
+	}
+	return "/dashboard/cluster/" + url.PathEscape(clientName) + "/tf/" + url.PathEscape(namespace) + "/" + url.PathEscape(name)
+}
+
+// DebugURL returns the websocket URL of a debug session.
+func (c *Client) DebugURL(r DebugRequest) (string, error) {
+	URL, err := url.Parse(c.Host)
+	if err != nil {
+		return "", err
+	}
+	if URL.Host == "" {
+		return "", fmt.Errorf("missing the hostname in %q", c.Host)
+	}
+	scheme := "ws"
+	if URL.Scheme == "https" {
+		scheme = "wss"
+	}
+	// RawPath keeps a "/" in a name escaped, it would be a separator in Path
+	debugURL := url.URL{
+		Scheme:  scheme,
+		Host:    URL.Host,
+		Path:    strings.TrimRight(URL.Path, "/") + "/api/v1/cluster/" + r.ClientName + "/debug/" + r.Namespace + "/" + r.Name,
+		RawPath: strings.TrimRight(URL.EscapedPath(), "/") + "/api/v1/cluster/" + url.PathEscape(r.ClientName) + "/debug/" + url.PathEscape(r.Namespace) + "/" + url.PathEscape(r.Name),
+	}
+	query := url.Values{}
+	if len(r.Command) > 0 {
+		query["command"] = r.Command
+	}
+	if r.Term != "" {
+		query.Set("term", r.Term)
+	}
+	if r.NoTTY {
+		query.Set("tty", "false")
+	}
+	if r.SessionID != "" {
+		query.Set("session", r.SessionID)
+	}
+	debugURL.RawQuery = query.Encode()
+	return debugURL.String(), nil
+}
+
+// DialDebug opens the websocket of a debug session with dialer.
+func (c *Client) DialDebug(ctx context.Context, dialer *websocket.Dialer, r DebugRequest) (*DebugSession, error) {
+	debugURL, err := c.DebugURL(r)
+	if err != nil {
+		return nil, err
+	}
+	conn, resp, err := dialer.DialContext(ctx, debugURL, c.header())
+	if err != nil && resp != nil {
+		defer resp.Body.Close()
+		_, err := readResponse(resp)
+		if err == nil {
+			err = &StatusError{StatusCode: resp.StatusCode, Message: resp.Status}
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DebugSession{Conn: conn, ID: resp.Header.Get(SessionIDHeader)}, nil
+}
+
+func (c *Client) header() http.Header {
+	header := c.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("User-Agent", c.UserAgent)
+	if c.Token != "" {
+		header.Set("Token", c.Token)
+	}
+	return header
+}
+
+// do sends request as JSON to path and returns the data of the response.
+func (c *Client) do(ctx context.Context, method, path string, request interface{}) (interface{}, error) {
+	var body io.Reader
+	if request != nil {
+		b, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.header()
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readResponse(resp)
+}
+
+// readResponse returns the data of an api.Response. Statuses other than 200
+// are returned as a *StatusError.
+func readResponse(resp *http.Response) (interface{}, error) {
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var respData api.Response
+	if err := json.Unmarshal(b, &respData); err != nil || respData.StatusInfo.StatusCode == 0 {
+		// Not a response of the API, eg from a proxy in front of it
+		if resp.StatusCode != http.StatusOK {
+			return nil, &StatusError{StatusCode: resp.StatusCode, Message: resp.Status}
+		}
+		return nil, fmt.Errorf("error parsing the response of %s: %s", resp.Request.URL.Redacted(), string(b))
+	}
+	if respData.StatusInfo.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: respData.StatusInfo.StatusCode, Message: respData.StatusInfo.Message}
+	}
+	return respData.Data, nil
+}
+
+// optional returns ErrNotSupported when the endpoint was not found
+func optional(err error) error {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusMethodNotAllowed) {
+		return ErrNotSupported
+	}
+	return err
+}
+
+// tokenFromData reads the token of a login, SSO or refresh response. It is
+// either the first item of the data, followed by an optional refresh token, or
+// an object with "token" and "refresh_token".
+func tokenFromData(data interface{}) (*Token, error) {
+	items, ok := data.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("the API did not return a token")
+	}
+	t := &Token{}
+	switch value := items[0].(type) {
+	case string:
+		t.Token = value
+		if len(items) > 1 {
+			t.RefreshToken, _ = items[1].(string)
+		}
+	case map[string]interface{}:
+		t.Token, _ = value["token"].(string)
+		t.RefreshToken, _ = value["refresh_token"].(string)
+	}
+	if t.Token == "" {
+		return nil, fmt.Errorf("the API did not return a token")
+	}
+	return t, nil
+}
+
+// names reads a list of names, either strings or objects with a "name"
+func names(data interface{}) []string {
+	items, _ := data.([]interface{})
+	var names []string
+	for _, item := range items {
+		switch value := item.(type) {
+		case string:
+			names = append(names, value)
+		case map[string]interface{}:
+			if name, ok := value["name"].(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// decode decodes data into v. Data wrapped in a list, as most responses of the
+// API are, is unwrapped.
+func decode(data interface{}, v interface{}) error {
+	if items, ok := data.([]interface{}); ok && len(items) == 1 {
+		data = items[0]
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,463 @@
+package stella
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/galleybytes/infrakube-stella/pkg/api"
+	"github.com/gorilla/websocket"
+)
+
+// writeResponse writes an api.Response with statusCode as both the HTTP
+// status and the status_code of the response, as the API does.
+func writeResponse(w http.ResponseWriter, statusCode int, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(api.Response{
+		StatusInfo: api.StatusInfo{StatusCode: statusCode, Message: message},
+		Data:       data,
+	})
+}
+
+// newTestClient returns a Client for a server running handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewClient(server.URL+"/", server.Client())
+}
+
+func TestConnecters(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    interface{}
+		want    []string
+		wantErr bool
+	}{
+		{name: "strings", data: []interface{}{"login", "sso"}, want: []string{"login", "sso"}},
+		{name: "objects", data: []interface{}{map[string]interface{}{"name": "sso"}, map[string]interface{}{"name": "device"}}, want: []string{"sso", "device"}},
+		{name: "empty", data: []interface{}{}, wantErr: true},
+		{name: "not a list", data: "login", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/connect" {
+					t.Errorf("got %s %s, want GET /connect", r.Method, r.URL.Path)
+				}
+				writeResponse(w, http.StatusOK, "", tt.data)
+			})
+			got, err := client.Connecters(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		for name, want := range map[string]string{
+			"User-Agent": "ik/1.2.3",
+			"Token":      "secret",
+			"X-Api-Key":  "key",
+			"Accept":     "application/json",
+		} {
+			if got := r.Header.Get(name); got != want {
+				t.Errorf("%s: got %q, want %q", name, got, want)
+			}
+		}
+		writeResponse(w, http.StatusOK, "", []interface{}{"login"})
+	})
+	client.UserAgent = "ik/1.2.3"
+	client.Token = "secret"
+	// Token and UserAgent take precedence over Header
+	client.Header = http.Header{"X-Api-Key": {"key"}, "User-Agent": {"other"}, "Token": {"other"}}
+	if _, err := client.Connecters(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    interface{}
+		want    *Token
+		wantErr bool
+	}{
+		{name: "token", data: []interface{}{"t1"}, want: &Token{Token: "t1"}},
+		{name: "token and refresh token", data: []interface{}{"t1", "r1"}, want: &Token{Token: "t1", RefreshToken: "r1"}},
+		{name: "object", data: []interface{}{map[string]interface{}{"token": "t1", "refresh_token": "r1"}}, want: &Token{Token: "t1", RefreshToken: "r1"}},
+		{name: "empty", data: []interface{}{}, wantErr: true},
+		{name: "null", data: nil, wantErr: true},
+		{name: "not a string", data: []interface{}{42}, wantErr: true},
+		{name: "object without a token", data: []interface{}{map[string]interface{}{"refresh_token": "r1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/login" {
+					t.Errorf("got %s %s, want POST /login", r.Method, r.URL.Path)
+				}
+				var body map[string]string
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("failed to decode the request: %s", err)
+				}
+				if body["user"] != "alice" || body["password"] != "pa55" {
+					t.Errorf("got request %v", body)
+				}
+				writeResponse(w, http.StatusOK, "", tt.data)
+			})
+			got, err := client.Login(context.Background(), "alice", "pa55")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/refresh" {
+			t.Errorf("got %s %s, want POST /refresh", r.Method, r.URL.Path)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode the request: %s", err)
+		}
+		if body["refresh_token"] != "r1" {
+			t.Errorf("got request %v", body)
+		}
+		writeResponse(w, http.StatusOK, "", []interface{}{"t2", "r2"})
+	})
+	got, err := client.Refresh(context.Background(), "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Token{Token: "t2", RefreshToken: "r2"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		call    func(*Client) error
+		// wantStatus is the StatusCode of the StatusError, 0 when err should
+		// be ErrNotSupported
+		wantStatus  int
+		wantMessage string
+	}{
+		{
+			name:        "unauthorized",
+			handler:     apiHandler(http.StatusUnauthorized, "invalid credentials"),
+			call:        login,
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "invalid credentials",
+		},
+		{
+			name:        "forbidden",
+			handler:     apiHandler(http.StatusForbidden, "not allowed"),
+			call:        clients,
+			wantStatus:  http.StatusForbidden,
+			wantMessage: "not allowed",
+		},
+		{
+			name:        "not found",
+			handler:     apiHandler(http.StatusNotFound, "no such page"),
+			call:        login,
+			wantStatus:  http.StatusNotFound,
+			wantMessage: "no such page",
+		},
+		{
+			name:        "server error",
+			handler:     apiHandler(http.StatusInternalServerError, "database is down"),
+			call:        login,
+			wantStatus:  http.StatusInternalServerError,
+			wantMessage: "database is down",
+		},
+		{
+			name: "status in the response only",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(api.Response{StatusInfo: api.StatusInfo{StatusCode: http.StatusUnauthorized, Message: "token expired"}})
+			},
+			call:        login,
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "token expired",
+		},
+		{
+			name: "not from the API",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "<html>Bad Gateway</html>", http.StatusBadGateway)
+			},
+			call:        login,
+			wantStatus:  http.StatusBadGateway,
+			wantMessage: "502 Bad Gateway",
+		},
+		{
+			name:    "optional endpoint not found",
+			handler: apiHandler(http.StatusNotFound, "no such page"),
+			call:    clients,
+		},
+		{
+			name: "optional endpoint method not allowed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			},
+			call: func(c *Client) error { return c.Revoke(context.Background()) },
+		},
+		{
+			name:    "refresh not supported",
+			handler: apiHandler(http.StatusNotFound, "no such page"),
+			call: func(c *Client) error {
+				_, err := c.Refresh(context.Background(), "r1")
+				return err
+			},
+		},
+		{
+			name:    "device login not supported",
+			handler: apiHandler(http.StatusNotFound, "no such page"),
+			call: func(c *Client) error {
+				_, err := c.DeviceCode(context.Background())
+				return err
+			},
+		},
+		{
+			name:        "optional endpoint failing",
+			handler:     apiHandler(http.StatusServiceUnavailable, "try again later"),
+			call:        clients,
+			wantStatus:  http.StatusServiceUnavailable,
+			wantMessage: "try again later",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call(newTestClient(t, tt.handler))
+			if tt.wantStatus == 0 {
+				if !errors.Is(err, ErrNotSupported) {
+					t.Fatalf("got %v, want ErrNotSupported", err)
+				}
+				return
+			}
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("got %v, want a StatusError", err)
+			}
+			if statusErr.StatusCode != tt.wantStatus || statusErr.Error() != tt.wantMessage {
+				t.Errorf("got %d %q, want %d %q", statusErr.StatusCode, statusErr.Error(), tt.wantStatus, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestInvalidResponse(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>Sign in</html>"))
+	})
+	_, err := client.Connecters(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "error parsing the response") {
+		t.Fatalf("got %v, want a parsing error", err)
+	}
+}
+
+func apiHandler(statusCode int, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, statusCode, message, nil)
+	}
+}
+
+func login(c *Client) error {
+	_, err := c.Login(context.Background(), "alice", "pa55")
+	return err
+}
+
+func clients(c *Client) error {
+	_, err := c.Clients(context.Background())
+	return err
+}
+
+func TestDebugURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		request DebugRequest
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "http",
+			host:    "http://stella.example.com",
+			request: DebugRequest{ClientName: "prod", Namespace: "default", Name: "vpc"},
+			want:    "ws://stella.example.com/api/v1/cluster/prod/debug/default/vpc",
+		},
+		{
+			name:    "https with a path",
+			host:    "https://example.com/stella/",
+			request: DebugRequest{ClientName: "prod", Namespace: "default", Name: "vpc"},
+			want:    "wss://example.com/stella/api/v1/cluster/prod/debug/default/vpc",
+		},
+		{
+			name:    "escaped names",
+			host:    "https://stella.example.com",
+			request: DebugRequest{ClientName: "a/b", Namespace: "default", Name: "vpc"},
+			want:    "wss://stella.example.com/api/v1/cluster/a%2Fb/debug/default/vpc",
+		},
+		{
+			name: "query",
+			host: "https://stella.example.com",
+			request: DebugRequest{
+				ClientName: "prod",
+				Namespace:  "default",
+				Name:       "vpc",
+				Command:    []string{"terraform", "plan"},
+				Term:       "xterm-256color",
+				NoTTY:      true,
+				SessionID:  "s-1",
+			},
+			want: "wss://stella.example.com/api/v1/cluster/prod/debug/default/vpc?command=terraform&command=plan&session=s-1&term=xterm-256color&tty=false",
+		},
+		{
+			name:    "missing hostname",
+			host:    "stella.example.com",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewClient(tt.host, nil).DebugURL(tt.request)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialDebug(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/cluster/prod/debug/default/vpc":
+		case "/api/v1/cluster/prod/debug/default/busy":
+			// Not a response of the API, eg from a load balancer
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		default:
+			writeResponse(w, http.StatusNotFound, "tf not found", nil)
+			return
+		}
+		if r.Header.Get("Token") != "secret" {
+			writeResponse(w, http.StatusUnauthorized, "invalid token", nil)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, http.Header{SessionIDHeader: {"s-1"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Echo the input back as output
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	})
+	client.Token = "secret"
+	ctx := context.Background()
+
+	session, err := client.DialDebug(ctx, websocket.DefaultDialer, DebugRequest{ClientName: "prod", Namespace: "default", Name: "vpc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if session.ID != "s-1" {
+		t.Errorf("got session ID %q, want s-1", session.ID)
+	}
+	if err := session.WriteMessage(websocket.TextMessage, []byte("1aGk=")); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := session.ReadMessage(); err != nil || string(message) != "1aGk=" {
+		t.Errorf("got %q %v, want the message echoed", message, err)
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		request     DebugRequest
+		wantStatus  int
+		wantMessage string
+	}{
+		{
+			name:        "not found",
+			token:       "secret",
+			request:     DebugRequest{ClientName: "prod", Namespace: "default", Name: "other"},
+			wantStatus:  http.StatusNotFound,
+			wantMessage: "tf not found",
+		},
+		{
+			name:        "unauthorized",
+			token:       "expired",
+			request:     DebugRequest{ClientName: "prod", Namespace: "default", Name: "vpc"},
+			wantStatus:  http.StatusUnauthorized,
+			wantMessage: "invalid token",
+		},
+		{
+			name:        "not from the API",
+			token:       "secret",
+			request:     DebugRequest{ClientName: "prod", Namespace: "default", Name: "busy"},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantMessage: "503 Service Unavailable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *client
+			c.Token = tt.token
+			_, err := c.DialDebug(ctx, websocket.DefaultDialer, tt.request)
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("got %v, want a StatusError", err)
+			}
+			if statusErr.StatusCode != tt.wantStatus || statusErr.Error() != tt.wantMessage {
+				t.Errorf("got %d %q, want %d %q", statusErr.StatusCode, statusErr.Error(), tt.wantStatus, tt.wantMessage)
+			}
+		})
+	}
+}
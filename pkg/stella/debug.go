@@ -0,0 +1,44 @@
+package stella
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Types of the text messages on the websocket of a debug session. A message
+// is its type followed by the base64 encoded payload.
+const (
+	// MessageInput is sent by the client with input for the remote command
+	MessageInput = '1'
+	// MessagePing is sent by the client, the server answers with MessagePong
+	MessagePing = '2'
+	// MessageResize is sent by the client with the size of the terminal as
+	// JSON, eg {"Columns": 80, "Rows": 24}
+	MessageResize = '3'
+	// MessageEOF is sent by the client to close the stdin of a session
+	// opened without a TTY
+	MessageEOF = '5'
+
+	// MessageOutput is sent by the server with output of the remote command
+	MessageOutput = '1'
+	// MessagePong is sent by the server in reply to MessagePing
+	MessagePong = '2'
+)
+
+// ExitStatus returns the exit status of the remote command from the error
+// returned by reading the websocket once the server closed it. The server
+// reports it as the reason of a normal closure, eg "exit status 2". It
+// returns false when the server didn't report a status.
+func ExitStatus(err error) (int, bool) {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure {
+		return 0, false
+	}
+	var status int
+	if _, err := fmt.Sscanf(closeErr.Text, "exit status %d", &status); err != nil {
+		return 0, false
+	}
+	return status, true
+}
@@ -0,0 +1,30 @@
+package stella
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantOK     bool
+	}{
+		{name: "exit status", err: &websocket.CloseError{Code: websocket.CloseNormalClosure, Text: "exit status 2"}, wantStatus: 2, wantOK: true},
+		{name: "no status", err: &websocket.CloseError{Code: websocket.CloseNormalClosure}},
+		{name: "abnormal closure", err: &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: "exit status 2"}},
+		{name: "other error", err: errors.New("exit status 2")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, ok := ExitStatus(tt.err)
+			if status != tt.wantStatus || ok != tt.wantOK {
+				t.Errorf("got %d %v, want %d %v", status, ok, tt.wantStatus, tt.wantOK)
+			}
+		})
+	}
+}